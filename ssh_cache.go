@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*============================================================================*/
+
+// file name -> mtime, zero if there is no such file
+type fileStamps map[string]time.Time
+
+func mtime(name string) (t time.Time) {
+	if st, err := os.Stat(name); err == nil {
+		t = st.ModTime()
+	}
+	return
+}
+
+func stampFiles(stamps fileStamps, files ...string) fileStamps {
+	if stamps == nil {
+		stamps = make(fileStamps)
+	}
+	for _, name := range files {
+		stamps[name] = mtime(name)
+	}
+	return stamps
+}
+
+func (self fileStamps) Changed() bool {
+	for name, t := range self {
+		if !mtime(name).Equal(t) {
+			log.Debug("%q changed", name)
+			return true
+		}
+	}
+	return false
+}
+
+/*============================================================================*/
+
+var shared_config = struct {
+	sync.Mutex
+	config *SshConfig
+	stamps fileStamps
+}{}
+
+// parsed once for all the contexts (and again if a file changes), never modify it
+func SharedSshConfig() *SshConfig {
+	shared_config.Lock()
+	defer shared_config.Unlock()
+	if shared_config.config != nil {
+		if !shared_config.stamps.Changed() {
+			return shared_config.config
+		}
+		log.Info("SSH config changed, reloading")
+	}
+	stamps := stampFiles(nil, ExpandHome("~/"+DefaultSshConfigFile), SystemSshConfigFile)
+	cf, err := LoadSshConfig()
+	switch {
+	case err != nil && shared_config.config == nil:
+		log.Fatal("%v", err) // nothing is done yet, as with NewSshConfig
+	case err != nil: // half edited, maybe; read again once it changes
+		log.Warn("%v; keeping the SSH config read before", err)
+		cf = shared_config.config
+	}
+	shared_config.stamps = stampFiles(stamps, cf.Files()...)
+	shared_config.config = cf
+	return cf
+}
+
+type sharedKnownHosts struct {
+	db     *KnownHosts
+	stamps fileStamps
+}
+
+var shared_known = struct {
+	sync.Mutex
+	dbs map[string]*sharedKnownHosts // by the list of files
+}{dbs: make(map[string]*sharedKnownHosts)}
+
+// like LoadKnownHosts, but loaded once per set of files (and again if one changes)
+func SharedKnownHosts(files ...string) (*KnownHosts, error) {
+	key := strings.Join(files, "\n")
+	shared_known.Lock()
+	defer shared_known.Unlock()
+	if known, ok := shared_known.dbs[key]; ok && !known.stamps.Changed() {
+		return known.db, nil
+	}
+	stamps := stampFiles(nil, files...)
+	db, err := LoadKnownHosts(files...)
+	if err != nil {
+		return nil, err
+	}
+	shared_known.dbs[key] = &sharedKnownHosts{db: db, stamps: stamps}
+	return db, nil
+}
+
+/* EOF */
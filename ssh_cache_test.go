@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+// the config parsed for each host, as it was before SharedSshConfig
+func BenchmarkNewSshConfig(b *testing.B) {
+	name := testSshConfig(b).Files()[0]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ResolveSshHost(NewSshConfig(name), "db1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSharedSshConfig(b *testing.B) {
+	cf := testSshConfig(b)
+	// as if SharedSshConfig had read the fixture
+	shared_config.config, shared_config.stamps = cf, stampFiles(nil, cf.Files()...)
+	b.Cleanup(func() { shared_config.config, shared_config.stamps = nil, nil })
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ResolveSshHost(SharedSshConfig(), "db1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+/* EOF */
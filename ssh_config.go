@@ -1,15 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"sort"
 	"strings"
-
-	"github.com/gobwas/glob"
 )
 
 /*============================================================================*/
 
-type SshConfigFileEntry map[string]string // key:value pairs like "Port":"2222"
+type SshConfigFileEntry map[string][][]string // keyword: the words of each line, like "port":[["2222"]], lowercase keys
 
 func (self *SshConfigFileEntry) IsNull() bool {
 	return self == nil || *self == nil
@@ -18,15 +17,47 @@ func (self *SshConfigFileEntry) Has(name string) bool {
 	if self == nil || *self == nil {
 		return false
 	}
-	_, ok := (*self)[name]
+	_, ok := (*self)[strings.ToLower(name)]
 	return ok
 }
+
+// the first value wins, as OpenSSH does
 func (self *SshConfigFileEntry) Get(name string) (value string, ok bool) {
+	args, ok := self.GetArgs(name)
+	if ok {
+		value = strings.Join(args, " ")
+	}
+	return
+}
+
+func (self *SshConfigFileEntry) GetValue(name, dflt string) string {
+	if value, ok := self.Get(name); ok {
+		return value
+	}
+	return dflt
+}
+
+// the words of the first value as parsed, for UserKnownHostsFile and the like
+func (self *SshConfigFileEntry) GetArgs(name string) (args []string, ok bool) {
 	if self == nil || *self == nil {
-		ok = false
 		return
 	}
-	value, ok = (*self)[name]
+	lines, ok := (*self)[strings.ToLower(name)]
+	if ok {
+		args = lines[0]
+	}
+	return
+}
+
+// for the keywords like IdentityFile which may be given many times, a value a line
+func (self *SshConfigFileEntry) GetAll(name string) (list []string, ok bool) {
+	if self == nil || *self == nil {
+		return
+	}
+	lines, ok := (*self)[strings.ToLower(name)]
+	for _, args := range lines {
+		list = append(list, strings.Join(args, " "))
+	}
 	return
 }
 func (self *SshConfigFileEntry) GetBool(name string) (value bool, ok bool) {
@@ -34,7 +65,7 @@ func (self *SshConfigFileEntry) GetBool(name string) (value bool, ok bool) {
 	if !ok {
 		return false, false
 	}
-	switch str {
+	switch strings.ToLower(str) {
 	case "yes":
 		return true, true
 	case "no":
@@ -44,11 +75,12 @@ func (self *SshConfigFileEntry) GetBool(name string) (value bool, ok bool) {
 	}
 	return false, false
 }
-func (self *SshConfigFileEntry) Set(name, value string) *SshConfigFileEntry {
+func (self *SshConfigFileEntry) Set(name string, args ...string) *SshConfigFileEntry {
 	if *self == nil {
-		*self = make(map[string]string)
+		*self = make(map[string][][]string)
 	}
-	(*self)[name] = strings.TrimSpace(value)
+	name = strings.ToLower(name)
+	(*self)[name] = append((*self)[name], args)
 	return self
 }
 func (self *SshConfigFileEntry) String() string {
@@ -59,116 +91,151 @@ func (self *SshConfigFileEntry) String() string {
 	sort.Strings(names)
 	var r []string
 	for _, name := range names {
-		value, ok := self.Get(name)
-		if !ok {
-			log.Fatal("No entry for %q", name)
+		for _, args := range (*self)[name] {
+			var words []string
+			for _, arg := range args {
+				if strings.ContainsAny(arg, " \t") {
+					arg = `"` + arg + `"`
+				}
+				words = append(words, arg)
+			}
+			r = append(r, "\t"+name+" "+strings.Join(words, " "))
 		}
-		r = append(r, "\t"+name+" "+value)
 	}
 	return strings.Join(r, "\n")
 }
 
+// keywords collected from all the matching sections, not only the first one
+var SshConfigLists = []string{
+	"IdentityFile", "CertificateFile",
+	"LocalForward", "RemoteForward", "DynamicForward", "SendEnv",
+}
+
+func isSshConfigList(name string) bool {
+	for _, x := range SshConfigLists {
+		if strings.EqualFold(x, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// the first value wins, except for SshConfigLists
+func (self *SshConfigFileEntry) Merge(other *SshConfigFileEntry) *SshConfigFileEntry {
+	if other.IsNull() {
+		return self
+	}
+	if *self == nil {
+		*self = make(map[string][][]string)
+	}
+	for name, lines := range *other {
+		if isSshConfigList(name) {
+			for _, args := range lines { // the final pass brings the same ones again
+				if !containsArgs((*self)[name], args) {
+					(*self)[name] = append((*self)[name], args)
+				}
+			}
+		} else if !self.Has(name) {
+			(*self)[name] = append([][]string(nil), lines...)
+		}
+	}
+	return self
+}
+
+func containsArgs(lines [][]string, args []string) bool {
+	for _, x := range lines {
+		if len(x) == len(args) && strings.Join(x, "\x00") == strings.Join(args, "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
 /*============================================================================*/
 
+// "Host a b !c" or "Match ..." with its entries
+type sshSection struct {
+	name     string   // as in the file, less the "Host"
+	patterns []string // of a Host line, lowercased
+	match    *SshMatch
+	entry    *SshConfigFileEntry
+}
+
+// Match sections are checked against what is known of the host so far;
+// host is the original one but in the final pass, where it's the HostName
+func (self *sshSection) applies(host, original string, known *SshConfigFileEntry, final bool) bool {
+	if IsMatchSection(self.name) {
+		return self.match != nil && self.match.Match(NewSshMatchContext(original, known, final))
+	}
+	return MatchPatternList(strings.ToLower(host), self.patterns)
+}
+
+func newSshSection(name string) (*sshSection, error) {
+	section := &sshSection{name: name, entry: new(SshConfigFileEntry)}
+	if IsMatchSection(name) {
+		m, err := ParseSshMatch(name)
+		if err != nil {
+			return nil, err
+		}
+		section.match = m
+	} else {
+		section.patterns = lowered(strings.Fields(name))
+	}
+	return section, nil
+}
+
 type SshConfigFile struct {
-	name  string                         // path
-	hosts []string                       // keep the sequence
-	entry map[string]*SshConfigFileEntry // actual data
-	globs map[string]glob.Glob           // possible wildcards handling
+	name     string        // path
+	files    []string      // read, the Included ones too
+	sections []*sshSection // keep the sequence
 }
 
 func (self *SshConfigFile) Length() int {
 	if self == nil {
 		return 0
 	}
-	return len(self.hosts)
+	return len(self.sections)
 }
 func (self *SshConfigFile) Append(other *SshConfigFile) *SshConfigFile {
-	for _, host := range other.hosts {
-		self.Set(host, other.entry[host])
-	}
+	self.sections = append(self.sections, other.sections...)
 	return self
 }
 func (self *SshConfigFile) Get(host, sect, dflt string) string {
-	res := dflt
-	x, h := self.get(host)
-	if h != nil {
-		v, ok := h.Get(sect)
-		if ok {
-			res = v
-		}
-	}
-	if host != x {
-		x = x + ">" + host
-	}
-	log.Debug("%q[%q.%q] (%q) = %q", self.name, x, sect, dflt, res)
+	res, _ := (&SshConfig{self}).Get(host, sect, dflt)
 	return res
 }
-func (self *SshConfigFile) get(name string) (string, *SshConfigFileEntry) {
-	if self == nil { // || *self == nil {
-		return name, nil
-	}
-	ent, ok := self.entry[name]
-	if ok {
-		return name, ent
-	}
-	for _, host := range self.hosts {
-		if host == name {
-			ent, ok = self.entry[name]
-			if !ok {
-				log.Fatal("%q equals %q, but nothing found",
-					name, host)
-			}
-			return host, ent
-		}
-		g, ok := self.globs[host]
-		if !ok {
-			log.Fatal("No entry for %q while looking for %q",
-				host, name)
-		}
-		if g.Match(name) {
-			ent, ok = self.entry[host]
-			if !ok {
-				log.Fatal("%q matched %q, but nothing found",
-					name, host)
-			}
-			return host, ent
-		}
-	}
-	return name, nil
-}
 func (self *SshConfigFile) Name() string {
 	return self.name
 }
 func (self *SshConfigFile) Len() int {
-	return len(self.hosts)
+	return len(self.sections)
 }
 func (self *SshConfigFile) Has(name string) bool {
-	_, h := self.get(name)
-	return h != nil
+	_, names := (&SshConfig{self}).merge(name)
+	return len(names) > 0
 }
 func (self *SshConfigFile) SetName(name string) *SshConfigFile {
 	self.name = name
 	return self
 }
 func (self *SshConfigFile) Set(name string, value *SshConfigFileEntry) *SshConfigFile {
-	if self.entry == nil {
-		self.entry = make(map[string]*SshConfigFileEntry)
-		self.globs = make(map[string]glob.Glob)
-	}
-	self.hosts = append(self.hosts, name)
-	g, err := glob.Compile(name)
+	section, err := newSshSection(name)
 	if err != nil {
-		log.Fatal("Bad glob %q", name)
+		log.Error("%q: %v", self.name, err)
+		section = &sshSection{name: name} // never matches
 	}
-	self.globs[name] = g
-	self.entry[name] = value
+	section.entry = value
+	self.sections = append(self.sections, section)
 	return self
 }
 func (self *SshConfigFile) String() string {
 	var list []string
-	for _, host := range self.hosts {
-		list = append(list, "Host "+host, self.entry[host].String())
+	for _, section := range self.sections {
+		if IsMatchSection(section.name) {
+			list = append(list, section.name, section.entry.String())
+			continue
+		}
+		list = append(list, "Host "+section.name, section.entry.String())
 	}
 	return "# " + self.name + " #\n" + strings.Join(list, "\n") + "\n# EOF #"
 }
@@ -178,52 +245,112 @@ func (self *SshConfigFile) String() string {
 type SshConfig []*SshConfigFile // just a sequence of config files
 
 func (self *SshConfig) Load(name string) {
+	if err := self.load(name); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+func (self *SshConfig) load(name string) error {
 	cfg, err := LoadSshConfigFile(name)
 	if err != nil {
-		log.Fatal("SSH config file %q: %v", name, err)
+		return fmt.Errorf("SSH config file %q: %v", name, err)
 	}
 	if cfg == nil {
-		return
+		return nil
 	}
 	log.Debug("SSH config file %q has %d host entries", cfg.Name(), cfg.Len())
 	*self = append(*self, cfg)
+	return nil
 }
 
-func (self *SshConfig) GetValue(host, name, dflt string) (res string) {
-	res, _ = self.Get(host, name, dflt)
+// all the files read, to see if any has changed
+func (self *SshConfig) Files() (list []string) {
+	for _, config := range *self {
+		if config != nil {
+			list = append(list, config.files...)
+		}
+	}
 	return
 }
 
-func (self *SshConfig) Get(host, name, dflt string) (res string, found bool) {
-	res = dflt
+// all the sections applying to the host, in order, as ssh -G does;
+// "Match final" makes a second pass with the HostName, as ssh does
+func (self *SshConfig) merge(host string) (res *SshConfigFileEntry, names []string) {
+	res = new(SshConfigFileEntry)
+	if self.pass(host, host, res, false, &names) {
+		name := host
+		if v, ok := res.Get("HostName"); ok {
+			name = strings.Replace(v, "%h", host, -1)
+		}
+		self.pass(name, host, res, true, &names)
+	}
+	return
+}
+
+// true if there is a "Match final" asking for another pass
+func (self *SshConfig) pass(host, original string, res *SshConfigFileEntry, final bool, names *[]string) (again bool) {
 	for _, config := range *self {
-		x, h := config.get(host)
-		if h == nil {
+		if config == nil {
 			continue
 		}
-		v, ok := h.Get(name)
-		if ok {
-			found = true
-			res = v
-		}
-		if host != x {
-			x = x + ">" + host
+		for _, section := range config.sections {
+			if section.match != nil && section.match.WantsFinal() {
+				again = true
+			}
+			if section.applies(host, original, res, final) {
+				*names = append(*names, section.name)
+				res.Merge(section.entry)
+			}
 		}
-		log.Debug("%q[%q.%q] (%q) = %q", config.name, x, name, dflt, res)
-		break
 	}
 	return
 }
 
+func (self *SshConfig) GetValue(host, name, dflt string) (res string) {
+	res, _ = self.Get(host, name, dflt)
+	return
+}
+
+func (self *SshConfig) Get(host, name, dflt string) (res string, found bool) {
+	res = dflt
+	merged, names := self.merge(host)
+	v, ok := merged.Get(name)
+	if ok {
+		found = true
+		res = v
+	}
+	log.Debug("%q%q.%q (%q) = %q", host, names, name, dflt, res)
+	return
+}
+
+// all the values from all the sections, like for IdentityFile
+func (self *SshConfig) GetAll(host, name string) (res []string) {
+	merged, names := self.merge(host)
+	res, _ = merged.GetAll(name)
+	log.Debug("%q%q.%q = %q", host, names, name, res)
+	return
+}
+
 func NewSshConfig(names ...string) *SshConfig {
+	cfg, err := LoadSshConfig(names...)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	return cfg
+}
+
+// as NewSshConfig, but an error is returned instead of stopping the run
+func LoadSshConfig(names ...string) (*SshConfig, error) {
 	cfg := new(SshConfig)
 	if len(names) == 0 {
 		names = []string{DefaultSshConfigFile, SystemSshConfigFile}
 	}
 	for _, name := range names {
-		cfg.Load(name)
+		if err := cfg.load(name); err != nil {
+			return nil, err
+		}
 	}
-	return cfg
+	return cfg, nil
 }
 
 /* EOF */
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/home/.ssh/config, with $HOME there for the Include
+func testSshConfig(t testing.TB) *SshConfig {
+	t.Helper()
+	home, err := filepath.Abs(filepath.Join("testdata", "home"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	return NewSshConfig(filepath.Join(home, ".ssh", "config"))
+}
+
+// as ssh -G would resolve them
+func TestResolveSshHost(t *testing.T) {
+	cf := testSshConfig(t)
+
+	for _, c := range []struct {
+		host, hostname, user, port string
+	}{
+		{"alias", "real.example.com", "first", "2201"}, // first value wins
+		{"x.example.com", "x.example.com", "second", "2299"},
+		{"web1", "web1", "deploy", "2202"},             // Host web* !web3
+		{"web3", "web3", "nobody", "22"},               // negated
+		{"db1", "db1.internal", "admin", "5432"},       // Match originalhost user
+		{"db2", "db2.internal", "admin", "6432"},       // Match host !originalhost
+		{"jump", "real.example.com", "nobody", "2299"}, // Match final
+		{"included", "inc.example.com", "inc", "2203"}, // Include
+		{"other", "other", "nobody", "22"},             // Host *
+	} {
+		h, err := ResolveSshHost(cf, c.host)
+		if err != nil {
+			t.Errorf("%s: %v", c.host, err)
+			continue
+		}
+		if h.HostName != c.hostname || h.User != c.user || h.Port != c.port {
+			t.Errorf("%s: got %s@%s:%s, want %s@%s:%s", c.host,
+				h.User, h.HostName, h.Port, c.user, c.hostname, c.port)
+		}
+	}
+}
+
+func TestSshConfigQuoted(t *testing.T) {
+	h, err := ResolveSshHost(testSshConfig(t), "spaced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"IdentityFile", h.IdentityFiles, []string{"/a b/key", "/c d/key"}},
+		{"UserKnownHostsFile", h.UserKnownHostsFiles, []string{"/e f/known_hosts", "/g/known_hosts"}},
+		{"CertificateFile", h.CertificateFiles, []string{`/h "i"/cert`, `/j "k"/cert`}},
+		{"User", []string{h.User}, []string{"me"}},
+	} {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.name, c.got, c.want)
+		}
+	}
+}
+
+// a config of the text given, in a temporary file
+func testSshConfigText(t *testing.T, text string) *SshConfig {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(name, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return NewSshConfig(name)
+}
+
+// yes, no and the like are case-insensitive
+func TestResolveSshHostCase(t *testing.T) {
+	type flags struct {
+		forward, only, hash bool
+		check               string
+	}
+	for _, c := range []struct {
+		line string
+		want flags
+	}{
+		{"ForwardAgent No", flags{check: HostKeyCheckAsk}},
+		{"ForwardAgent FALSE", flags{check: HostKeyCheckAsk}},
+		{"ForwardAgent Yes", flags{forward: true, check: HostKeyCheckAsk}},
+		{"IdentitiesOnly Yes", flags{only: true, check: HostKeyCheckAsk}},
+		{"HashKnownHosts YES", flags{hash: true, check: HostKeyCheckAsk}},
+		{"StrictHostKeyChecking Yes", flags{check: HostKeyCheckYes}},
+		{"StrictHostKeyChecking Off", flags{check: HostKeyCheckNo}},
+		{"StrictHostKeyChecking Accept-New", flags{check: HostKeyCheckAcceptNew}},
+	} {
+		h, err := ResolveSshHost(testSshConfigText(t, "Host *\n    "+c.line+"\n"), "h")
+		if err != nil {
+			t.Errorf("%s: %v", c.line, err)
+			continue
+		}
+		got := flags{h.ForwardAgent, h.IdentitiesOnly, h.HashKnownHosts, h.StrictHostKeyChecking}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.line, got, c.want)
+		}
+	}
+}
+
+// for SharedSshConfig to keep the config it has
+func TestLoadSshConfigError(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(name, []byte("Host x\n    Port\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cf, err := LoadSshConfig(name); err == nil {
+		t.Errorf("no error, got %v", cf)
+	}
+}
+
+/* EOF */
@@ -1,17 +1,93 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/user"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
+type TimeoutError struct {
+	Command string
+	After   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.After)
+}
+
+type HostKeyError struct {
+	Host   string
+	Reason string
+}
+
+func (e *HostKeyError) Error() string {
+	return fmt.Sprintf("Host key for %q %s", e.Host, e.Reason)
+}
+
+// a failure to connect to the host or a loss of the connection,
+// as opposed to a command that ran and failed
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+func IsConnectError(err error) bool {
+	var he *HostKeyError
+	if errors.As(err, &he) || IsAuthError(err) {
+		return false // retrying won't help, and may lock the account
+	}
+	var ce *ConnectError
+	var me *ssh.ExitMissingError
+	var pe *PeerUnresponsiveError
+	return errors.As(err, &ce) || errors.As(err, &me) || errors.As(err, &pe) ||
+		errors.Is(err, io.EOF)
+}
+
+// no replies to keepalives, the connection is torn down
+type PeerUnresponsiveError struct {
+	Host   string
+	Missed int
+}
+
+func (e *PeerUnresponsiveError) Error() string {
+	return fmt.Sprintf("peer unresponsive: %s did not answer %d keepalives", e.Host, e.Missed)
+}
+
+// remote command exit status, if err carries one
+func ExitStatus(err error) (int, bool) {
+	var ee *ssh.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitStatus(), true
+	}
+	var me *MuxExitError
+	if errors.As(err, &me) {
+		return me.Status, true
+	}
+	return 0, false
+}
+
+// how long to wait for the session to go after it's been closed on timeout
+const CloseTimeout = 5 * time.Second
+
+const KeepAliveRequest = "keepalive@openssh.com"
+
 type Context struct {
 	Id           int
 	User         string
@@ -21,11 +97,26 @@ type Context struct {
 	ForwardAgent bool
 	UseTty       bool
 	Config       *SshConfig
-	Ssh          struct {
+	Settings     *SshHost
+	Jump         string // ProxyJump like "user@bastion:port,next-hop"
+	ProxyCommand string // used if no Jump
+	PasswordFrom string // job's password_from, empty for keys only
+	// a copy of the output goes there as it comes, if set;
+	// one for each stream, for their lines not to mix
+	Stream    io.Writer
+	StreamErr io.Writer
+	// zero means no limit
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+	// zero interval means no keepalives
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+	Ssh                 struct {
 		Agent        agent.ExtendedAgent
 		ClientConfig *ssh.ClientConfig
 		Client       *ssh.Client
 		session      *ssh.Session
+		mux          *MuxClient // instead of the above, if there is a master
 	}
 	Time struct {
 		Start time.Time
@@ -33,9 +124,18 @@ type Context struct {
 	}
 }
 
-func (context *Context) Run(command string, args ...string) (out string, err error) {
-	context.Connect()
+func (context *Context) Run(command string, args ...string) *Result {
+	res := NewResult(context.Host)
+	res.Start = time.Now()
+	defer func() {
+		res.Stop = time.Now()
+	}()
 	defer context.Close()
+	err := context.Connect()
+	if err != nil {
+		res.SetError(&ConnectError{err})
+		return res
+	}
 
 	cmd := command
 	if len(args) > 0 {
@@ -56,39 +156,159 @@ func (context *Context) Run(command string, args ...string) (out string, err err
 
 	// context.Ssh.session.Setenv("name", "value")
 
+	var dead int32
+	if context.Ssh.mux == nil && context.ServerAliveInterval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go context.keepAlive(context.Ssh.Client, stop, &dead)
+	}
+
 	context.Time.Start = time.Now()
-	data, err := context.Ssh.session.CombinedOutput(cmd)
+	stdout, stderr, err := context.output(cmd)
 	context.Time.Stop = time.Now()
+	if atomic.LoadInt32(&dead) != 0 {
+		err = &PeerUnresponsiveError{Host: context.Host, Missed: context.ServerAliveCountMax}
+	}
 	if err != nil {
 		log.Debug("[%d] SSH session (%q): %v", context.Id, cmd, err)
+	} else {
+		res.ExitStatus = 0
 	}
-	out = string(data)
+	res.Stdout, res.Stderr = string(stdout), string(stderr)
+	res.SetError(err)
+	return res
+}
 
-	return
+// drops the client once the peer misses ServerAliveCountMax keepalives in a row
+func (context *Context) keepAlive(client *ssh.Client, stop <-chan struct{}, dead *int32) {
+	ticker := time.NewTicker(context.ServerAliveInterval)
+	defer ticker.Stop()
+	replies := make(chan error, 1) // one request at a time
+	pending, missed := false, 0
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-replies:
+			pending = false
+			if err == nil { // any reply will do, even a failure
+				missed = 0
+			}
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := client.SendRequest(KeepAliveRequest, true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			missed += 1
+			if missed >= context.ServerAliveCountMax {
+				log.Warn("[%d] @%q: no reply to %d keepalives, disconnecting",
+					context.Id, context.Host, missed)
+				atomic.StoreInt32(dead, 1)
+				client.Close()
+				return
+			}
+		}
+	}
 }
 
-func (context *Context) Validate() {
+func (context *Context) output(cmd string) (stdout, stderr []byte, err error) {
+	// a session given up on may still write, but not to the streams the caller flushes
+	stream, stream_err := &detachWriter{w: context.Stream}, &detachWriter{w: context.StreamErr}
+	defer stream.Detach()
+	defer stream_err.Detach()
+	var run = func() ([]byte, []byte, error) {
+		var obuf, ebuf bytes.Buffer
+		var out, errs io.Writer = &obuf, &ebuf
+		if context.Stream != nil {
+			out = io.MultiWriter(out, stream)
+		}
+		if context.StreamErr != nil {
+			errs = io.MultiWriter(errs, stream_err)
+		}
+		if context.Ssh.mux != nil {
+			err := context.Ssh.mux.Run(cmd, context.UseTty, context.ForwardAgent, out, errs)
+			return obuf.Bytes(), ebuf.Bytes(), err
+		}
+		context.Ssh.session.Stdout = out
+		context.Ssh.session.Stderr = errs
+		err := context.Ssh.session.Run(cmd)
+		return obuf.Bytes(), ebuf.Bytes(), err
+	}
+	if context.Timeout <= 0 {
+		return run()
+	}
+
+	type ran struct {
+		stdout, stderr []byte
+		err            error
+	}
+	done := make(chan ran, 1)
+	go func() {
+		o, e, err := run()
+		done <- ran{o, e, err}
+	}()
+
+	timer := time.NewTimer(context.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.stdout, r.stderr, r.err
+	case <-timer.C:
+	}
+
+	timeout := &TimeoutError{Command: cmd, After: context.Timeout}
+	log.Debug("[%d] Timed out after %s, killing %q", context.Id, context.Timeout, cmd)
+	if context.Ssh.mux != nil { // the master closes the session once we are gone
+		context.Ssh.mux.Close()
+		r := <-done
+		return r.stdout, r.stderr, timeout
+	}
+	context.Ssh.session.Signal(ssh.SIGTERM)
+	context.Ssh.session.Close()
+	select {
+	case r := <-done:
+		return r.stdout, r.stderr, timeout
+	case <-time.After(CloseTimeout):
+		// the connection is shared with other jobs, so it stays
+		log.Debug("[%d] Session is still there, giving up on it", context.Id)
+	}
+	return nil, nil, timeout
+}
+
+func (context *Context) Validate() error {
 	if context.Host == "" {
-		log.Fatal("[%d] Context %+v has no \"Host\" entry", context.Id, context)
+		return fmt.Errorf("Context %+v has no \"Host\" entry", context)
 	}
+	return nil
 }
 
+// the client stays in the pool till ClosePool
 func (context *Context) Close() {
 	if context.Ssh.session != nil {
 		context.Ssh.session.Close()
 		context.Ssh.session = nil
 	}
-	if context.Ssh.Client != nil {
-		context.Ssh.Client.Close()
-		context.Ssh.Client = nil
+	if context.Ssh.mux != nil {
+		context.Ssh.mux.Close()
+		context.Ssh.mux = nil
 	}
+	context.Ssh.Client = nil
 }
 
 func (context *Context) endpoint() string {
-	return net.JoinHostPort(context.Host, context.Port)
+	return net.JoinHostPort(context.Settings.HostName, context.Port)
 }
 
-func (context *Context) requestPty() {
+// "user@host:port"
+func (context *Context) poolKey() string {
+	return context.User + "@" + context.endpoint()
+}
+
+func (context *Context) requestPty() error {
 	log.Debug("[%d] Requesting a tty", context.Id)
 	err := context.Ssh.session.RequestPty(
 		"pty", 80, 25,
@@ -98,126 +318,440 @@ func (context *Context) requestPty() {
 			ssh.TTY_OP_OSPEED: 19200,
 		})
 	if err != nil {
-		log.Fatal("[%d] Cannot request tty: %v", context.Id, err)
+		return fmt.Errorf("Cannot request tty: %v", err)
 	}
 	log.Debug("[%d] Got a tty!", context.Id)
+	return nil
+}
+
+func (context *Context) dial() (*ssh.Client, error) {
+	context.Ssh.ClientConfig.Timeout = context.ConnectTimeout
+	if context.Jump != "" {
+		via, err := JumpClient(context.Id, ParseJump(context.Jump), context.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("jump %q: %v", context.Jump, err)
+		}
+		log.Debug("[%d] Dialing %s via %q", context.Id, context.endpoint(), context.Jump)
+		conn, err := via.Dial("tcp", context.endpoint())
+		if err != nil {
+			return nil, err
+		}
+		return context.handshake(conn)
+	}
+	if context.ProxyCommand != "" {
+		command := ProxyCommandLine(context.ProxyCommand,
+			context.Settings.HostName, context.Port, context.User, context.Host)
+		conn, err := DialProxyCommand(command)
+		if err != nil {
+			return nil, fmt.Errorf("ProxyCommand %q: %v", command, err)
+		}
+		return context.handshake(conn)
+	}
+	conn, err := net.DialTimeout("tcp", context.endpoint(), context.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return context.handshake(conn)
 }
 
-func (context *Context) Connect() {
-	context.Validate()
+func (context *Context) handshake(conn net.Conn) (*ssh.Client, error) {
+	var timer *time.Timer
+	if context.ConnectTimeout > 0 { // ClientConfig.Timeout does not cover the handshake
+		timer = time.AfterFunc(context.ConnectTimeout, func() { conn.Close() })
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, context.endpoint(), context.Ssh.ClientConfig)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("handshake timed out after %s", context.ConnectTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	clnt, err := ssh.Dial("tcp", context.endpoint(), context.Ssh.ClientConfig)
+func (context *Context) openSession() (reused bool, err error) {
+	clnt, reused, err := PoolClient(context.poolKey(), context.dial)
 	if err != nil {
-		log.Fatal("[%d] SSH client[%s]: %v", context.Id, context.endpoint(), err)
+		return false, fmt.Errorf("SSH client[%s]: %w", context.endpoint(), err)
 	}
 	context.Ssh.Client = clnt
 
 	if context.ForwardAgent {
-		if context.Ssh.Agent == nil {
-			log.Fatal("[%d] No agent.", context.Id)
-		}
-		err := agent.ForwardToAgent(context.Ssh.Client, context.Ssh.Agent)
+		err = PoolForwardAgent(context.poolKey(), clnt, context.Ssh.Agent)
 		if err != nil {
-			log.Fatal("[%d] SetupForwardKeyring: %v", context.Id, err)
+			return reused, fmt.Errorf("SetupForwardKeyring: %w", err)
 		}
-		log.Debug("[%d] ForwardAgent: yes", context.Id)
 	}
 
-	context.Ssh.session, err = context.Ssh.Client.NewSession()
+	context.Ssh.session, err = clnt.NewSession()
 	if err != nil {
-		log.Fatal("[%d] SSH client session: %v", context.Id, err)
+		return reused, fmt.Errorf("SSH client session: %w", err)
+	}
+	return reused, nil
+}
+
+func (context *Context) Connect() error {
+	err := context.Validate()
+	if err != nil {
+		return err
+	}
+
+	if context.Settings.ControlPath != "" {
+		path := ControlPathLine(context.Settings.ControlPath, context.Settings.HostName,
+			context.Port, context.User, context.Host, context.Jump)
+		mux, err := DialMux(path)
+		if err == nil {
+			log.Debug("[%d] Using ControlMaster at %q", context.Id, path)
+			context.Ssh.mux = mux
+			return nil
+		}
+		log.Debug("[%d] No ControlMaster: %v", context.Id, err)
+	}
+
+	if context.ForwardAgent && context.Ssh.Agent == nil {
+		return errors.New("No agent to forward")
+	}
+	reused, err := context.openSession()
+	// it may have died since, so once again; but a refusal like MaxSessions
+	// leaves it as it is for the others using it
+	if err != nil && reused && (errors.Is(err, io.EOF) || !PoolAlive(context.Ssh.Client)) {
+		log.Debug("[%d] Pooled connection to %q failed: %v", context.Id, context.poolKey(), err)
+		PoolDrop(context.poolKey(), context.Ssh.Client)
+		_, err = context.openSession()
+	}
+	if err != nil {
+		return err
 	}
 
 	if context.UseTty {
-		context.requestPty()
+		err = context.requestPty()
+		if err != nil {
+			return err
+		}
 	}
 
 	if context.ForwardAgent {
 		err = agent.RequestAgentForwarding(context.Ssh.session)
 		if err != nil {
-			log.Fatal("[%d] agent.ForwardToRemote: %v", context.Id, err)
+			return fmt.Errorf("agent.ForwardToRemote: %v", err)
 		}
 		log.Debug("[%d] ForwardAgent: yes", context.Id)
 	}
+	return nil
 }
 
-func (context *Context) hostKeyMethod() ssh.HostKeyCallback {
-	hkey := context.findHostKey()
-	if hkey == nil {
-		log.Error("[%d] No known host key for %+q", context.Id, context.Host)
-		return ssh.InsecureIgnoreHostKey()
+func (context *Context) hostKeyMethod() (ssh.HostKeyCallback, error) {
+	err := context.Validate()
+	if err != nil {
+		return nil, err
 	}
-	return ssh.FixedHostKey(hkey)
+	return context.checkHostKey, nil
 }
 
-func (context *Context) findHostKey() ssh.PublicKey {
-	context.Validate()
+// host name as known_hosts has it
+func (context *Context) hostKeyName() string {
+	if context.Port == DefaultSshPort {
+		return context.Settings.HostName
+	}
+	return fmt.Sprintf("[%s]:%s", context.Settings.HostName, context.Port)
+}
 
-	path := FindHostKeyFile("")
-	log.Debug("[%d] Host keys from %q", context.Id, path)
-	if path == "" {
-		log.Warn("[%d] No key file for host %q", context.Id, context.Host)
-		return nil
+// host certificates are checked against @cert-authority, plain keys as they are
+func (context *Context) checkHostKey(addr string, remote net.Addr, key ssh.PublicKey) error {
+	host := context.hostKeyName()
+	db, err := context.knownHosts()
+	if err != nil {
+		return err
+	}
+	checker := ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return ContainsKey(db.Authorities(host), auth)
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return db.IsRevoked(host, cert.SignatureKey) || db.IsRevoked(host, cert.Key)
+		},
+		HostKeyFallback: func(addr string, remote net.Addr, key ssh.PublicKey) error {
+			return context.checkPlainHostKey(db, host, key)
+		},
+	}
+	err = checker.CheckHostKey(addr, remote, key)
+	var he *HostKeyError
+	if err != nil && !errors.As(err, &he) {
+		err = &HostKeyError{host, "certificate: " + err.Error()}
 	}
+	return err
+}
 
-	var tries []string
+func (context *Context) checkPlainHostKey(db *KnownHosts, host string, key ssh.PublicKey) error {
+	if db.IsRevoked(host, key) {
+		return &HostKeyError{host, fmt.Sprintf("%s %s is revoked",
+			key.Type(), ssh.FingerprintSHA256(key))}
+	}
+	known := db.HostKeys(host)
+	if ContainsKey(known, key) {
+		return nil
+	}
+	for _, k := range known {
+		if k.Type() == key.Type() {
+			return &HostKeyError{host, fmt.Sprintf("has changed: known %s, offered %s",
+				ssh.FingerprintSHA256(k), ssh.FingerprintSHA256(key))}
+		}
+	}
 
-	tries = append(tries, context.Host)
-	tries = append(tries, fmt.Sprintf("[%s]:%s", context.Host, context.Port))
+	fp := ssh.FingerprintSHA256(key)
+	switch context.Settings.StrictHostKeyChecking {
+	case HostKeyCheckNo:
+		log.Warn("[%d] Accepting unknown %s key %s for %q", context.Id, key.Type(), fp, host)
+		return nil
+	case HostKeyCheckAcceptNew:
+		path := context.knownHostsFileToWrite()
+		if path == "" {
+			log.Warn("[%d] Accepting unknown %s key %s for %q, UserKnownHostsFile is none",
+				context.Id, key.Type(), fp, host)
+			return nil
+		}
+		log.Warn("[%d] Adding %s key %s for %q to %q", context.Id, key.Type(), fp, host, path)
+		err := AddHostKey(path, host, key, context.Settings.HashKnownHosts)
+		if err != nil {
+			return &HostKeyError{host, "cannot be saved: " + err.Error()}
+		}
+		return nil
+	}
+	return &HostKeyError{host, fmt.Sprintf("is unknown (%s %s) and StrictHostKeyChecking is %q",
+		key.Type(), fp, context.Settings.StrictHostKeyChecking)}
+}
 
-	for _, pattern := range tries {
-		r := FindHostKey(path, pattern)
-		if r != nil {
-			return r
+func (context *Context) knownHostsFiles() (list []string) {
+	list = append(list, context.Settings.UserKnownHostsFiles...)
+	if len(list) == 0 && !context.Settings.NoUserKnownHosts {
+		if path := FindHostKeyFile(""); path != "" {
+			list = append(list, path)
 		}
 	}
-	log.Warn("[%d] No key for host %q", context.Id, context.Host)
+	list = append(list, context.Settings.GlobalKnownHostsFiles...)
+	return
+}
+
+// none if UserKnownHostsFile is none
+func (context *Context) knownHostsFileToWrite() string {
+	if context.Settings.NoUserKnownHosts {
+		return ""
+	}
+	if len(context.Settings.UserKnownHostsFiles) > 0 {
+		return context.Settings.UserKnownHostsFiles[0]
+	}
+	return ExpandHome("~/" + DefaultSshKnownHosts)
+}
+
+// a port other than the configured one, like a jump hop's;
+// the host keys are looked up as [host]:port then
+func (context *Context) SetPort(port string) error {
+	context.Port = port
+	db, err := context.knownHosts()
+	if err != nil {
+		return err
+	}
+	context.Ssh.ClientConfig.HostKeyAlgorithms = db.Algorithms(context.hostKeyName())
 	return nil
 }
 
-func (context *Context) authMethods() []ssh.AuthMethod {
+func (context *Context) knownHosts() (*KnownHosts, error) {
+	files := context.knownHostsFiles()
+	log.Debug("[%d] Host keys from %q", context.Id, files)
+	return SharedKnownHosts(files...)
+}
+
+func (context *Context) authMethods() ([]ssh.AuthMethod, error) {
 	var auth []ssh.AuthMethod
+	var failure error
+	var certs []*ssh.Certificate
+	for _, file := range context.Settings.CertificateFiles {
+		cert, err := LoadCertificate(file)
+		if err != nil {
+			log.Warn("[%d] %v", context.Id, err)
+			failure = err
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	var agent_keys []ssh.Signer
 	if context.Ssh.Agent != nil {
 		log.Debug("[%d] Using agent via %q", context.Id, os.Getenv(SSH_AUTH_SOCK))
-		auth = append(auth, ssh.PublicKeysCallback(context.Ssh.Agent.Signers))
+		list, err := context.Ssh.Agent.Signers()
+		if err != nil {
+			log.Warn("[%d] Agent: %v", context.Id, err)
+		}
+		agent_keys = list
+	}
+	var in_agent = func(key ssh.PublicKey) ssh.Signer {
+		for _, signer := range agent_keys {
+			if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+				return signer
+			}
+		}
+		return nil
+	}
+
+	files := context.Settings.IdentityFiles
+	if len(files) == 0 {
+		files = FindSshPvtKeyFiles("")
+	}
+	// identities held by the agent go first, then the rest of the agent, then the files
+	var from_agent, from_files []ssh.Signer
+	for _, file := range files {
+		if FileExists(file + CertificateFileSuffix) {
+			cert, err := LoadCertificate(file + CertificateFileSuffix)
+			if err != nil {
+				log.Warn("[%d] %v", context.Id, err)
+			} else {
+				certs = append(certs, cert)
+			}
+		}
+		pub, err := LoadPublicKey(file + DefaultSshKeyFilePubSuffix)
+		if err != nil {
+			log.Warn("[%d] %v", context.Id, err)
+		}
+		if pub != nil {
+			if signer := in_agent(pub); signer != nil {
+				log.Debug("[%d] Using agent key for %q", context.Id, file)
+				from_agent = append(from_agent, signer)
+				continue
+			}
+		}
+		if !FileExists(file) {
+			log.Debug("[%d] No private key %q", context.Id, file)
+			continue
+		}
+		pk, err := LoadPrivateKey(file)
+		if err != nil {
+			log.Warn("[%d] %v", context.Id, err)
+			failure = err
+			continue
+		}
+		if pk == nil {
+			continue
+		}
+		if signer := in_agent(pk.PublicKey()); signer != nil {
+			log.Debug("[%d] Using agent key for %q", context.Id, file)
+			from_agent = append(from_agent, signer)
+			continue
+		}
+		log.Debug("[%d] Using private key %q", context.Id, file)
+		from_files = append(from_files, pk)
+	}
+	signers := from_agent
+	if !context.Settings.IdentitiesOnly {
+		for _, signer := range agent_keys {
+			if !ContainsKey(publicKeys(from_agent), signer.PublicKey()) {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	signers = append(signers, from_files...)
+
+	methods := PasswordMethods(context.Id, context.PasswordFrom,
+		context.Settings.NumberOfPasswordPrompts)
+	if len(signers) > 0 {
+		if methods == nil {
+			methods = make(map[string]ssh.AuthMethod)
+		}
+		methods[AuthPublicKey] = ssh.PublicKeys(WithCertificates(signers, certs)...)
+	}
+	for _, name := range context.Settings.PreferredAuthentications {
+		if method, ok := methods[name]; ok {
+			log.Debug("[%d] Offering %q authentication", context.Id, name)
+			auth = append(auth, method)
+		}
 	}
-	pk := LoadPrivateKey()
-	if pk != nil {
-		log.Debug("[%d] Using private key", context.Id)
-		auth = append(auth, ssh.PublicKeys(LoadPrivateKey()))
+	if len(auth) == 0 && failure != nil {
+		return nil, failure
 	}
-	return auth
+	return auth, nil
 }
 
-func NewContext(id int, host string, use_term bool, force_user string) *Context {
+// to be called before Connect, as the job says
+func (context *Context) UsePassword(from string) error {
+	if from == context.PasswordFrom {
+		return nil
+	}
+	context.PasswordFrom = from
+	auth, err := context.authMethods()
+	if err != nil {
+		return err
+	}
+	context.Ssh.ClientConfig.Auth = auth
+	return nil
+}
+
+func publicKeys(signers []ssh.Signer) (list []ssh.PublicKey) {
+	for _, signer := range signers {
+		list = append(list, signer.PublicKey())
+	}
+	return
+}
+
+func NewContext(id int, host string, use_term bool, force_user string) (*Context, error) {
 	u, err := user.Current()
 	if err != nil {
-		log.Fatal("[%d] No current user: %v", id, err)
+		return nil, fmt.Errorf("No current user: %v", err)
 	}
 	log.Debug("[%d] Running as %q (%s)", id, u.Username, u.Name)
-	cf := NewSshConfig()
+	cf := SharedSshConfig()
+	settings, err := ResolveSshHost(cf, host)
+	if err != nil {
+		return nil, err
+	}
 	cx := Context{
-		Id:           id,
-		User:         u.Username,
-		Gecos:        u.Name,
-		Host:         host,
-		Port:         cf.GetValue(host, "Port", "22"),
-		UseTty:       use_term,
-		ForwardAgent: cf.GetValue(host, "ForwardAgent", "no") == "yes",
-		Config:       cf,
+		Id:             id,
+		User:           u.Username,
+		Gecos:          u.Name,
+		Host:           host,
+		Port:           settings.Port,
+		UseTty:         use_term,
+		ForwardAgent:   settings.ForwardAgent,
+		Config:         cf,
+		Settings:       settings,
+		ConnectTimeout: settings.ConnectTimeout,
+		Jump:           settings.ProxyJump,
+		ProxyCommand:   settings.ProxyCommand,
+
+		ServerAliveInterval: settings.ServerAliveInterval,
+		ServerAliveCountMax: settings.ServerAliveCountMax,
+	}
+	if settings.User != "" {
+		cx.User = settings.User
+		cx.Gecos = "configured " + settings.User
 	}
 	if force_user != "" {
 		cx.User = force_user
 		cx.Gecos = "enforced " + force_user
 	}
 	cx.Ssh.Agent = newSshAgentClient()
+	auth, err := cx.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	hkey, err := cx.hostKeyMethod()
+	if err != nil {
+		return nil, err
+	}
+	db, err := cx.knownHosts()
+	if err != nil {
+		return nil, err
+	}
 	cx.Ssh.ClientConfig = &ssh.ClientConfig{
-		User:            cx.User,
-		Auth:            cx.authMethods(),
-		BannerCallback:  ssh.BannerDisplayStderr(),
-		HostKeyCallback: cx.hostKeyMethod(),
+		User:              cx.User,
+		Auth:              auth,
+		BannerCallback:    ssh.BannerDisplayStderr(),
+		HostKeyCallback:   hkey,
+		HostKeyAlgorithms: db.Algorithms(cx.hostKeyName()),
 	}
-	return &cx
+	return &cx, nil
 }
 
 /* EOF */
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// nothing is read from or written to a file named "none"
+func TestKnownHostsNone(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	h, err := ResolveSshHost(testSshConfigText(t, "Host *\n"+
+		"    UserKnownHostsFile none\n"+
+		"    GlobalKnownHostsFile none\n"+
+		"    StrictHostKeyChecking accept-new\n"), "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.NoUserKnownHosts || len(h.UserKnownHostsFiles) > 0 || len(h.GlobalKnownHostsFiles) > 0 {
+		t.Errorf("got %v %q %q", h.NoUserKnownHosts, h.UserKnownHostsFiles, h.GlobalKnownHostsFiles)
+	}
+
+	cx := &Context{Port: DefaultSshPort, Settings: h}
+	if files := cx.knownHostsFiles(); len(files) > 0 {
+		t.Errorf("reads %q", files)
+	}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadKnownHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cx.checkPlainHostKey(db, "h", key); err != nil {
+		t.Errorf("accept-new: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(".", "none")); err == nil {
+		t.Error("./none is written")
+	}
+}
+
+/* EOF */
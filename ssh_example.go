@@ -39,6 +39,9 @@ import (
 
 var log = logging.Root
 
+var ErrCheckFailed = errors.New("output check failed")
+var ErrSkipped = errors.New("not run, too many hosts failed (max_fail)")
+
 var Config struct {
 	LogLevel    string
 	DefaultDir  string
@@ -50,14 +53,21 @@ var Config struct {
 	Edit        bool
 	Copy        string
 	Create      bool
+	Parallel    int
+	Stream      bool
+	Report      string
+	ReportFile  string
+	//
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
 	//
 	Color                                                                         aurora.Aurora
 	ErrorColor, FileColor, TitleColor, OkColor, CommentColor, NameColor, DivColor func(s string) string
 }
 
-var lock_elapsed sync.Mutex
-var elapsed map[int]time.Duration
-var result map[int]error
+var report *Report // all the tasks, done or not
+
+var slots chan struct{} // limits running tasks across all jobs, nil if unlimited
 
 func IsAtty(f *os.File) bool {
 	var fd uintptr = f.Fd()
@@ -65,21 +75,20 @@ func IsAtty(f *os.File) bool {
 	return err == nil
 }
 
-func elapse(task int, d time.Duration, e error) {
-	lock_elapsed.Lock()
-	defer lock_elapsed.Unlock()
-	elapsed[task] = d // it has to be locked. real shit.
-	result[task] = e
+func acquire() {
+	if slots != nil {
+		slots <- struct{}{}
+	}
 }
 
-func totals() (failed int, total time.Duration) {
-	for t, v := range elapsed {
-		total += v
-		if result[t] != nil {
-			failed += 1
-		}
+func release() {
+	if slots != nil {
+		<-slots
 	}
-	return
+}
+
+func output_prefix(task int, host string) string {
+	return host + ":" + strconv.FormatInt(int64(task), 10) + ":"
 }
 
 func show_output(task int, host, text string) {
@@ -90,56 +99,177 @@ func show_output(task int, host, text string) {
 		digits += 1
 		nl /= 10
 	}
-	prefix := host + ":" + strconv.FormatInt(int64(task), 10) + ":"
+	prefix := output_prefix(task, host)
+	lock_stdout.Lock()
+	defer lock_stdout.Unlock()
 	for _, line := range lines {
 		os.Stdout.Write([]byte(prefix + line + "\n"))
 	}
 }
 
-func save_output(context *Context, command, out string) {
+// the file name saved to, if any
+func save_output(context *Context, command string, res *Result, tries []string) string {
 	if Config.SaveDir == "" {
-		return
+		return ""
 	}
 	fname := filepath.Join(Config.SaveDir, context.Host)
 	data := "# Host:    " + context.Host + "\n" +
 		"# Command: " + command + "\n" +
-		"# User:    " + context.User + " (" + context.Gecos + ")\n" +
-		"# Started: " + context.Time.Start.String() + "\n" +
-		"# Ended:   " + context.Time.Stop.String() + "\n" +
-		"# Elapsed: " + context.Time.Stop.Sub(context.Time.Start).String() + "\n" +
-		"\n" + out + "\n### EOF ###\n"
+		"# User:    " + context.User + " (" + context.Gecos + ")\n"
+	for _, try := range tries {
+		data += "# Attempt: " + try + "\n"
+	}
+	data += "# Started: " + res.Start.String() + "\n" +
+		"# Ended:   " + res.Stop.String() + "\n" +
+		"# Elapsed: " + res.Elapsed().String() + "\n" +
+		"# Result:  " + res.Status() + "\n"
+	if res.Failed() {
+		data += "# Error:   " + res.Err.Error() + "\n"
+	}
+	data += "\n" + res.Stdout + "\n"
+	if res.Stderr != "" {
+		data += "### STDERR ###\n" + res.Stderr + "\n"
+	}
+	data += "### EOF ###\n"
 	err := ioutil.WriteFile(fname, []byte(data), 0640)
 	if err != nil {
 		log.Error("[%d] Cannot save %q: %v", context.Id, fname, err)
+		return ""
 	}
+	return fname
+}
+
+// the report takes stdout, if nothing else
+func report_to_stdout() bool {
+	return Config.Report != "" && Config.ReportFile == ""
 }
 
-func run(wg *sync.WaitGroup, context *Context, job *Job) {
-	log.Info("[%d] @%q: %q", context.Id, context.Host, job.Command)
+func run(wg *sync.WaitGroup, task int, host string, job *Job) {
+	defer wg.Done()
+
+	context, err := NewContext(task, host, job.UseTty, job.User)
+	if err != nil {
+		log.Warn("[%d] @%q: %v", task, host, err)
+		report.Done(NewReportRecord(task, job, nil, NewResult(host).SetError(err), nil, ""))
+		return
+	}
+	err = context.UsePassword(job.PasswordFrom)
+	if err != nil {
+		log.Warn("[%d] @%q: %v", task, host, err)
+		report.Done(NewReportRecord(task, job, context, NewResult(host).SetError(err), nil, ""))
+		return
+	}
+	connect, timeout := job.Timeouts()
+	if connect > 0 { // otherwise keep the one from ssh config
+		context.ConnectTimeout = connect
+	}
+	context.Timeout = timeout
+	if job.ServerAliveInterval > 0 {
+		context.ServerAliveInterval = time.Duration(job.ServerAliveInterval)
+	}
+	if job.ServerAliveCountMax > 0 {
+		context.ServerAliveCountMax = job.ServerAliveCountMax
+	}
+	var stream, stream_err *LineWriter // the same prefix, but a line of its own
+	if Config.Stream {
+		prefix := Config.NameColor(output_prefix(task, host))
+		stream, stream_err = NewLineWriter(os.Stdout, prefix), NewLineWriter(os.Stdout, prefix)
+		context.Stream, context.StreamErr = stream, stream_err
+	}
+	switch job.Jump {
+	case "": // as ssh config says
+	case "none":
+		context.Jump = ""
+	default:
+		context.Jump = job.Jump
+	}
 
+	var res *Result
+	var tries []string
 	t1 := time.Now()
-	out, err := context.Run(job.Command)
-	t2 := time.Now()
+	for attempt := 1; ; attempt++ {
+		if job.Retries > 0 {
+			log.Info("[%d] @%q: %q (attempt %d of %d)",
+				context.Id, context.Host, job.Command, attempt, job.Retries+1)
+		} else {
+			log.Info("[%d] @%q: %q", context.Id, context.Host, job.Command)
+		}
+		started := time.Now()
+		res = context.Run(job.Command)
+		err = res.Err
+		if stream != nil {
+			stream.Flush()
+			stream_err.Flush()
+		}
+		if err == nil || attempt > job.Retries || !job.Retryable(err) {
+			if job.Retries > 0 {
+				tries = append(tries, fmt.Sprintf("%d of %d", attempt, job.Retries+1))
+			}
+			break
+		}
+		delay := job.Backoff(attempt)
+		log.Warn("[%d] @%q: attempt %d failed: %v, retrying in %s",
+			context.Id, context.Host, attempt, err, delay)
+		tries = append(tries, fmt.Sprintf("%d failed at %s: %v", attempt, started, err))
+		time.Sleep(delay)
+	}
+	res.Start = t1 // the retries count too
+	if res.Class == ClassRemoteExit && job.ExpectFor(host).ExitAllowed(res.ExitStatus) {
+		err = res.SetError(nil).Err
+	}
 
 	f, e, ok := log.Info, Config.OkColor("ok"), true
 	if ok && err != nil {
-		f, e, ok = log.Warn, err.Error(), false
+		f, e, ok = log.Warn, res.Status()+": "+err.Error(), false
 	}
 
-	dt := t2.Sub(t1)
-	elapse(context.Id, dt, err)
-
-	if ok && !job.Check(out) {
-		f, e, ok = log.Warn, "output check failed", false
+	if ok {
+		if failed := job.Check(res); len(failed) > 0 {
+			res.SetError(&CheckError{failed})
+			f, e, ok = log.Warn, res.Err.Error(), false
+		}
 	}
 
-	f("[%d] @%q: %v, %s", context.Id, context.Host, e, dt)
+	f("[%d] @%q: %v, %s", context.Id, context.Host, e, res.Elapsed())
+
+	saved := save_output(context, job.Command, res, tries)
+	report.Done(NewReportRecord(context.Id, job, context, res, tries, saved))
+	if !ok && stream == nil && !report_to_stdout() { // it's been seen already otherwise
+		show_output(context.Id, context.Host, res.Output())
+	}
+}
 
-	save_output(context, job.Command, out)
-	if !ok {
-		show_output(context.Id, context.Host, out)
+// runs the job on the hosts given, returns the number of failed ones
+func run_wave(job *Job, hosts []string) int {
+	workers := len(hosts)
+	if job.Parallel > 0 && job.Parallel < workers {
+		workers = job.Parallel
+	}
+	type work struct {
+		task int
+		host string
+	}
+	queue := make(chan work)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for w := range queue {
+				acquire()
+				run(&wg, w.task, job.Fqdn(w.host), job)
+				release()
+			}
+		}()
+	}
+	var list []int
+	for _, host := range hosts {
+		task := report.NewTask()
+		list = append(list, task)
+		wg.Add(1)
+		queue <- work{task, host}
 	}
-	wg.Done()
+	close(queue)
+	wg.Wait()
+	return report.Failures(list)
 }
 
 func bash(args ...string) error {
@@ -151,6 +281,9 @@ func bash(args ...string) error {
 	log.Debug("%q %#v", cmd.Path, cmd.Args)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
+	if report_to_stdout() { // not to break the JSON
+		cmd.Stdout = os.Stderr
+	}
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
 	if err != nil {
@@ -214,6 +347,19 @@ func LocalConfig() *flag.FlagSet {
 	flags.BoolVar(&Config.Create, "create", Config.Create, "create a new yaml")
 	flags.BoolVar(&Config.Create, "c", Config.Create, " short for --create")
 
+	flags.IntVar(&Config.Parallel, "parallel", Config.Parallel,
+		"max number of hosts to run on at once, 0 for no limit")
+	flags.BoolVar(&Config.Stream, "stream", Config.Stream,
+		"show the output as it comes, line by line, prefixed with host:task:")
+	flags.StringVar(&Config.Report, "report", Config.Report,
+		"write a report of all the tasks: json (once done) or ndjson (as they are done)")
+	flags.StringVar(&Config.ReportFile, "report-file", Config.ReportFile,
+		"where to write the report to, stdout if not set")
+	flags.DurationVar(&Config.ConnectTimeout, "connect-timeout", Config.ConnectTimeout,
+		"default time limit to connect to a host, 0 for no limit")
+	flags.DurationVar(&Config.Timeout, "timeout", Config.Timeout,
+		"default time limit for a command to run, 0 for no limit")
+
 	if FileExists(ConfigFile) {
 		// log.Say("Reading %q...", ConfigFile)
 		bytes, err := ioutil.ReadFile(ConfigFile)
@@ -336,7 +482,25 @@ func main() {
 		}
 	}
 
-	var do_the_job = func(task *int, job *Job, wg *sync.WaitGroup) {
+	if err := ValidReport(Config.Report); err != nil {
+		log.Fatal("--report: %v", err)
+	}
+	if Config.Stream && report_to_stdout() {
+		log.Fatal("Both --stream and --report want stdout, use --report-file")
+	}
+	report = NewReport(Config.Report, os.Stdout)
+	if Config.Report != "" && Config.ReportFile != "" {
+		f, err := os.Create(Config.ReportFile)
+		if err != nil {
+			log.Fatal("Cannot create %q: %v", Config.ReportFile, err)
+		}
+		defer f.Close()
+		report = NewReport(Config.Report, f)
+	}
+
+	SharedSshConfig() // once for all the hosts
+
+	var do_the_job = func(job *Job, wg *sync.WaitGroup) {
 		job.Lock()
 		defer func() {
 			job.Unlock()
@@ -355,14 +519,25 @@ func main() {
 			}
 		}
 
-		wgx := sync.WaitGroup{}
-		for _, host := range job.Hosts {
-			elapsed[*task] = 0
-			wgx.Add(1)
-			go run(&wgx, NewContext(*task, job.Fqdn(host), job.UseTty, job.User), job)
-			*task += 1
+		size, _ := job.BatchSize()
+		limit, _ := job.FailLimit()
+		failed := 0
+		for start := 0; start < len(job.Hosts); start += size {
+			if limit >= 0 && failed > limit {
+				log.Warn("Job %q: %d hosts failed (max %d), skipping %d more",
+					job.Title, failed, limit, len(job.Hosts)-start)
+				report.Skip(job, job.Hosts[start:])
+				break
+			}
+			end := start + size
+			if end > len(job.Hosts) {
+				end = len(job.Hosts)
+			}
+			if size < len(job.Hosts) {
+				log.Info("Job %q: hosts %d..%d of %d", job.Title, start+1, end, len(job.Hosts))
+			}
+			failed += run_wave(job, job.Hosts[start:end])
 		}
-		wgx.Wait()
 
 		if job.After != "" {
 			log.Info("After %q performing %q", job.Title, job.After)
@@ -373,9 +548,9 @@ func main() {
 		}
 	}
 
-	task := 0
-	elapsed = make(map[int]time.Duration)
-	result = make(map[int]error)
+	if Config.Parallel > 0 {
+		slots = make(chan struct{}, Config.Parallel)
+	}
 	wg := sync.WaitGroup{}
 	t1 := time.Now()
 	for _, arg := range flags.Args() {
@@ -391,19 +566,34 @@ func main() {
 		}
 
 		wg.Add(1)
-		go do_the_job(&task, job, &wg)
+		go do_the_job(job, &wg)
 	}
 	t2 := time.Now()
 
 	log.Debug("All started in %s", t2.Sub(t1))
 	wg.Wait()
+	ClosePool()
 	t2 = time.Now()
 
-	failed, total := totals()
+	report.Close()
+
+	failed, skips, total, classes := report.Totals()
+	tasks := report.Tasks()
 	log.Info("Total run time %s for %d tasks in %s (%.1f× speedup)",
-		total, len(elapsed), t2.Sub(t1), total.Seconds()/t2.Sub(t1).Seconds())
+		total, tasks, t2.Sub(t1), total.Seconds()/t2.Sub(t1).Seconds())
 	if failed != 0 {
-		log.Warn("There were %d failed tasks out of %d, %.0f%%",
-			failed, len(result), float64(100*failed)/float64(len(result)))
+		var kinds []string
+		for _, class := range []string{ClassConnect, ClassAuth, ClassHostKey, ClassTimeout,
+			ClassRemoteExit, ClassCheck, ClassError} {
+			if classes[class] > 0 {
+				kinds = append(kinds, fmt.Sprintf("%d %s", classes[class], class))
+			}
+		}
+		log.Warn("There were %d failed tasks out of %d, %.0f%% (%s)",
+			failed, tasks, float64(100*failed)/float64(tasks),
+			strings.Join(kinds, ", "))
+	}
+	if skips != 0 {
+		log.Warn("There were %d skipped tasks", skips)
 	}
 }
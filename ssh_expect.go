@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*============================================================================*/
+
+// the names of the assertions that did not hold
+type CheckError struct {
+	Failed []string
+}
+
+func (e *CheckError) Error() string {
+	return ErrCheckFailed.Error() + ": " + strings.Join(e.Failed, "; ")
+}
+
+func (e *CheckError) Unwrap() error {
+	return ErrCheckFailed
+}
+
+// the "expect:" block of a job, all the assertions given must hold
+type Expect struct {
+	Contains    string            `yaml:"contains,omitempty"`     // like "check:"
+	NotContains string            `yaml:"not_contains,omitempty"` // must not be in stdout or stderr
+	Regex       string            `yaml:"regex,omitempty"`        // must match somewhere in stdout or stderr
+	Exit        []int             `yaml:"exit,omitempty"`         // exit codes that are fine, [0] if not set
+	StderrEmpty bool              `yaml:"stderr_empty,omitempty"` // nothing on stderr
+	Json        map[string]string `yaml:"json,omitempty"`         // JSONPath -> value, for JSON stdout
+
+	re *regexp.Regexp
+}
+
+func (self *Expect) Validate() error {
+	if self == nil {
+		return nil
+	}
+	if self.Regex != "" {
+		re, err := regexp.Compile(self.Regex)
+		if err != nil {
+			return fmt.Errorf("regex: %v", err)
+		}
+		self.re = re
+	}
+	for path := range self.Json {
+		if _, err := parseJsonPath(path); err != nil {
+			return fmt.Errorf("json: %v", err)
+		}
+	}
+	return nil
+}
+
+// as Job.View shows the rest, each line indented
+func (self *Expect) View(show func(string), indent string) {
+	if self == nil {
+		return
+	}
+	var field = func(name, value string) {
+		show(indent + Config.NameColor(name) + Config.DivColor(": ") + value)
+	}
+	if self.Contains != "" {
+		field("contains", self.Contains)
+	}
+	if self.NotContains != "" {
+		field("not_contains", self.NotContains)
+	}
+	if self.Regex != "" {
+		field("regex", self.Regex)
+	}
+	if len(self.Exit) > 0 {
+		var codes []string
+		for _, code := range self.Exit {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		field("exit", "["+strings.Join(codes, ", ")+"]")
+	}
+	if self.StderrEmpty {
+		field("stderr_empty", "true")
+	}
+	if len(self.Json) > 0 {
+		show(indent + Config.NameColor("json") + Config.DivColor(":"))
+		var paths []string
+		for path := range self.Json {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			show(indent + "    " + Config.NameColor(path) + Config.DivColor(": ") + self.Json[path])
+		}
+	}
+}
+
+// a non-zero exit status listed in "exit:" is not a failure
+func (self *Expect) ExitAllowed(status int) bool {
+	if self == nil {
+		return false
+	}
+	for _, code := range self.Exit {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// the failed assertions, by name
+func (self *Expect) Check(res *Result) (failed []string) {
+	if self == nil {
+		return nil
+	}
+	text := res.Output()
+	if self.Contains != "" && !strings.Contains(text, self.Contains) {
+		failed = append(failed, fmt.Sprintf("contains %q", self.Contains))
+	}
+	if self.NotContains != "" && strings.Contains(text, self.NotContains) {
+		failed = append(failed, fmt.Sprintf("not_contains %q", self.NotContains))
+	}
+	if self.re != nil && !self.re.MatchString(text) {
+		failed = append(failed, fmt.Sprintf("regex %q", self.Regex))
+	}
+	if len(self.Exit) > 0 && !self.ExitAllowed(res.ExitStatus) {
+		failed = append(failed, fmt.Sprintf("exit %d not in %v", res.ExitStatus, self.Exit))
+	}
+	if self.StderrEmpty && res.Stderr != "" {
+		failed = append(failed, "stderr_empty")
+	}
+	if len(self.Json) == 0 {
+		return
+	}
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(res.Stdout))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return append(failed, "json: "+err.Error())
+	}
+	var paths []string
+	for path := range self.Json {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		want := self.Json[path]
+		got, err := JsonPath(doc, path)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("json %s: %v", path, err))
+		} else if got != want {
+			failed = append(failed, fmt.Sprintf("json %s = %q, not %q", path, got, want))
+		}
+	}
+	return
+}
+
+/*----------------------------------------------------------------------------*/
+
+// a JSONPath subset: $.name.name[index]["name"]
+func parseJsonPath(path string) (steps []interface{}, err error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%q does not start with $", path)
+	}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			n := strings.IndexAny(rest[1:], ".[") + 1
+			if n == 0 {
+				n = len(rest)
+			}
+			if n == 1 {
+				return nil, fmt.Errorf("%q: empty name", path)
+			}
+			steps, rest = append(steps, rest[1:n]), rest[n:]
+		case '[':
+			n := strings.IndexByte(rest, ']')
+			if n < 0 {
+				return nil, fmt.Errorf("%q: no ]", path)
+			}
+			key := rest[1:n]
+			if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+				steps = append(steps, key[1:len(key)-1])
+			} else if i, err := strconv.Atoi(key); err == nil {
+				steps = append(steps, i)
+			} else {
+				return nil, fmt.Errorf("%q: bad index %q", path, key)
+			}
+			rest = rest[n+1:]
+		default:
+			return nil, fmt.Errorf("%q: unexpected %q", path, rest)
+		}
+	}
+	return
+}
+
+// the value at path as text: strings as they are, the rest as JSON
+func JsonPath(doc interface{}, path string) (string, error) {
+	steps, err := parseJsonPath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, step := range steps {
+		switch key := step.(type) {
+		case string:
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("not an object at %q", key)
+			}
+			if doc, ok = obj[key]; !ok {
+				return "", fmt.Errorf("no %q", key)
+			}
+		case int:
+			list, ok := doc.([]interface{})
+			if !ok {
+				return "", fmt.Errorf("not an array at [%d]", key)
+			}
+			i := key
+			if i < 0 { // from the end
+				i += len(list)
+			}
+			if i < 0 || i >= len(list) {
+				return "", fmt.Errorf("no [%d]", key)
+			}
+			doc = list[i]
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+/* EOF */
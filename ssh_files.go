@@ -1,12 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	fpth "path"
 	"path/filepath"
-	"regexp"
 	"strings"
 )
 
@@ -14,12 +14,21 @@ import (
 
 const (
 	SystemSshConfigFile        = "/etc/ssh/ssh_config"
+	SystemSshKnownHosts        = "/etc/ssh/ssh_known_hosts"
 	DefaultSshConfigFile       = ".ssh/config"
 	DefaultSshKnownHosts       = ".ssh/known_hosts"
-	DefaultSshKeyFile          = ".ssh/id_rsa"
 	DefaultSshKeyFilePubSuffix = ".pub"
+	CertificateFileSuffix      = "-cert.pub"
 )
 
+var DefaultSshKeyFiles = []string{
+	".ssh/id_rsa",
+	".ssh/id_ecdsa",
+	".ssh/id_ecdsa_sk",
+	".ssh/id_ed25519",
+	".ssh/id_ed25519_sk",
+}
+
 /*============================================================================*/
 
 func getSshUser(name string) (u *user.User, err error) {
@@ -68,31 +77,20 @@ func FindHostKeyFile(username string) (path string) {
 	return
 }
 
-func FindSshPubKeyFile(username string) (path string) {
-	u, err := getSshUser(username)
+// existing default private keys, in the order OpenSSH tries them
+func FindSshPvtKeyFiles(username string) (list []string) {
+	u, _ := getSshUser(username)
 	if u == nil {
 		return
 	}
-	path, err = findSshFile(u.Username, DefaultSshKeyFile+DefaultSshKeyFilePubSuffix)
-	if err != nil {
-		log.Warn("Cannot find pub key %q for user %q in %q: %v",
-			DefaultSshKeyFile+DefaultSshKeyFilePubSuffix,
-			u.Username, path, err)
-		path = ""
-	}
-	return
-}
-
-func FindSshPvtKeyFile(username string) (path string) {
-	u, err := getSshUser(username)
-	if u == nil {
-		return
+	for _, name := range DefaultSshKeyFiles {
+		path := fpth.Join(u.HomeDir, name)
+		if FileExists(path) {
+			list = append(list, path)
+		}
 	}
-	path, err = findSshFile(u.Username, DefaultSshKeyFile)
-	if err != nil {
-		log.Warn("Cannot find key %q for user %q in %q: %v",
-			DefaultSshKeyFile, u.Username, path, err)
-		path = ""
+	if len(list) == 0 {
+		log.Warn("No private key files for user %q in %q", u.Username, u.HomeDir)
 	}
 	return
 }
@@ -111,6 +109,19 @@ func FindSshConfigFile(username string) (path string) {
 	return
 }
 
+// "~/x" -> "$HOME/x"
+func ExpandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Warn("Cannot expand %q: %v", path, err)
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
 /*============================================================================*/
 func IsCommentOrBlank(line string) bool {
 	const comment = "#"
@@ -120,15 +131,18 @@ func IsCommentOrBlank(line string) bool {
 
 /*============================================================================*/
 
-var leadingSpace_re = regexp.MustCompile(`^\s+`)
-var spaces_re = regexp.MustCompile(`\s+`)
+const MaxIncludeDepth = 16 // as OpenSSH has it
 
-func LoadSshConfigFile(name string) (cfg *SshConfigFile, e error) {
-	const (
-		nl = "\n"
-		sp = " "
-	)
+// keywords taking the rest of the line as is
+var sshConfigRaw = []string{"proxycommand", "localcommand", "remotecommand", "knownhostscommand"}
 
+type sshConfigParser struct {
+	cfg     *SshConfigFile
+	section *sshSection // the current one, nil before the first Host or Match
+	dir     string      // where the relative Includes are
+}
+
+func LoadSshConfigFile(name string) (cfg *SshConfigFile, e error) {
 	log.Debug("Loading %q...", name)
 
 	fname := name
@@ -139,89 +153,132 @@ func LoadSshConfigFile(name string) (cfg *SshConfigFile, e error) {
 			return
 		}
 	}
+	dir := ExpandHome("~/.ssh")
+	if fname == SystemSshConfigFile {
+		dir = filepath.Dir(SystemSshConfigFile)
+	}
 
-	bytes, e := ioutil.ReadFile(fname)
+	p := &sshConfigParser{cfg: new(SshConfigFile).SetName(fname), dir: dir}
+	e = p.parse(fname, 0)
 	if e != nil {
-		log.Error("Cannot read %q: %v", name, e)
-		return
+		return nil, e
 	}
+	log.Debug("Loaded %q (entries: %d)", fname, p.cfg.Length())
+	return p.cfg, nil
+}
 
-	var host string
-	var entry *SshConfigFileEntry
-	for i, line := range strings.Split(string(bytes), nl) {
-		// log.Debug("%q[%d]: %q", name, i + 1, line)
-		if IsCommentOrBlank(line) {
-			continue
+func (self *sshConfigParser) parse(name string, depth int) error {
+	bytes, e := ioutil.ReadFile(name)
+	if e != nil {
+		if depth == 0 && os.IsNotExist(e) {
+			log.Debug("No %q", name)
+			return nil
 		}
-		if strings.HasPrefix(line, "Include") {
-			// Include /etc/ssh/ssh_config.d/*.conf
-			pattern := strings.TrimSpace(line[7:])
-			if pattern == "" {
-				log.Error("%q[%d]: %q - no value", name, i+1, line)
-				continue
-			}
-			list, e := filepath.Glob(pattern)
-			if e != nil {
-				log.Error("%q[%d]: %q - bad pattern (%v)", name, i+1, line, e)
-				continue
-			}
-			if len(list) == 0 {
-				log.Debug("%q[%d]: %q - no files match pattern %q",
-					name, i+1, line, pattern)
-				continue
-			}
-			for _, xname := range list {
-				cf, e := LoadSshConfigFile(xname)
-				if e != nil {
-					log.Error("%q[%d]: %q - subconfig %q error: %v",
-						name, i+1, line, xname, e)
-					continue
-				}
-				if cf == nil {
-					log.Warn("%q[%d]: %q - subconfig %q has no entries",
-						name, i+1, line, xname)
-					continue
-				}
-				if cfg == nil {
-					cfg = cf
-				} else {
-					cfg.Append(cf)
-				}
-				cf = nil
-			}
-			continue
+		return e
+	}
+	self.cfg.files = append(self.cfg.files, name)
+	for i, line := range strings.Split(string(bytes), "\n") {
+		e = self.line(strings.TrimSpace(line), depth)
+		if e != nil {
+			return fmt.Errorf("%s:%d: %v", name, i+1, e)
 		}
-		if strings.HasPrefix(line, "Host") {
-			// Host *
-			if !entry.IsNull() {
-				if cfg == nil {
-					cfg = new(SshConfigFile).SetName(fname)
-				}
-				cfg.Set(host, entry)
+	}
+	return nil
+}
+
+// "Keyword value", "Keyword=value" or "Keyword = value"
+func splitKeyword(line string) (keyword, rest string) {
+	n := strings.IndexAny(line, " \t=")
+	if n < 0 {
+		return line, ""
+	}
+	keyword, rest = line[:n], strings.TrimLeft(line[n:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	return
+}
+
+func (self *sshConfigParser) line(line string, depth int) error {
+	if IsCommentOrBlank(line) {
+		return nil
+	}
+	keyword, rest := splitKeyword(line)
+	if rest == "" {
+		return fmt.Errorf("%s: no value", keyword)
+	}
+	lower := strings.ToLower(keyword)
+	if lower == "match" {
+		return self.open(MatchSection + " " + rest)
+	}
+	if ContainsString(sshConfigRaw, lower) {
+		return self.set(keyword, rest)
+	}
+	words, e := SplitQuoted(rest)
+	if e != nil {
+		return fmt.Errorf("%s: %v", keyword, e)
+	}
+	switch lower {
+	case "host":
+		return self.open(strings.Join(words, " "))
+	case "include":
+		for _, pattern := range words {
+			e = self.include(pattern, depth+1)
+			if e != nil {
+				return e
 			}
-			host = strings.TrimSpace(line[4:])
-			entry = new(SshConfigFileEntry)
-			continue
 		}
-		if leadingSpace_re.MatchString(line) {
-			line = strings.TrimSpace(spaces_re.ReplaceAllString(line, sp))
-			word := strings.Split(line, sp)
-			tag, word := word[0], word[1:]
-			entry.Set(tag, strings.Join(word, sp))
-			continue
+		return nil
+	}
+	return self.set(keyword, words...)
+}
+
+func (self *sshConfigParser) open(name string) error {
+	section, e := newSshSection(name)
+	if e != nil {
+		return e
+	}
+	self.cfg.sections = append(self.cfg.sections, section)
+	self.section = section
+	return nil
+}
+
+// the lines before any Host are for all the hosts
+func (self *sshConfigParser) set(keyword string, args ...string) error {
+	if self.section == nil {
+		e := self.open("*")
+		if e != nil {
+			return e
 		}
-		log.Error("%q[%d]: %q - bad entry", name, i+1, line)
 	}
-	if entry.IsNull() {
-		entry = nil // let GC to do its job, if any
-	} else {
-		if cfg == nil {
-			cfg = new(SshConfigFile).SetName(fname)
+	self.section.entry.Set(keyword, args...)
+	return nil
+}
+
+// Include ~/.ssh/config.d/*.conf
+func (self *sshConfigParser) include(pattern string, depth int) error {
+	if depth > MaxIncludeDepth {
+		return fmt.Errorf("Include %q: nested too deep", pattern)
+	}
+	path := ExpandHome(ExpandEnv(pattern))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(self.dir, path)
+	}
+	list, e := filepath.Glob(path)
+	if e != nil {
+		return fmt.Errorf("Include %q: %v", pattern, e)
+	}
+	if len(list) == 0 {
+		log.Debug("Include %q: no files match %q", pattern, path)
+		return nil
+	}
+	for _, name := range list {
+		e = self.parse(name, depth)
+		if e != nil {
+			return e
 		}
-		cfg.Set(host, entry)
 	}
-	log.Debug("Loaded %q (entries: %d)", fname, cfg.Length())
-	return
+	return nil
 }
 
 /* EOF */
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*============================================================================*/
+
+const (
+	DefaultSshPort             = "22"
+	DefaultServerAliveCountMax = 3
+	DefaultPasswordPrompts     = 3
+)
+
+// PreferredAuthentications values we know of
+const (
+	AuthPublicKey           = "publickey"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthPassword            = "password"
+
+	DefaultPreferredAuthentications = "gssapi-with-mic,hostbased,publickey,keyboard-interactive,password"
+)
+
+// StrictHostKeyChecking values
+const (
+	HostKeyCheckYes       = "yes"
+	HostKeyCheckAsk       = "ask"
+	HostKeyCheckAcceptNew = "accept-new"
+	HostKeyCheckNo        = "no"
+)
+
+// what ssh_config has to say about a host, all the defaults applied
+type SshHost struct {
+	Name                  string   // as given, may be an alias
+	HostName              string   // the one to connect to
+	User                  string   // empty if not configured
+	Port                  string   //
+	IdentityFiles         []string // empty if not configured
+	CertificateFiles      []string // empty if not configured
+	IdentitiesOnly        bool
+	ConnectTimeout        time.Duration
+	ServerAliveInterval   time.Duration
+	ServerAliveCountMax   int
+	StrictHostKeyChecking string
+	UserKnownHostsFiles   []string // empty if not configured
+	NoUserKnownHosts      bool     // "UserKnownHostsFile none", nothing to read or write
+	GlobalKnownHostsFiles []string
+	HashKnownHosts        bool
+	ForwardAgent          bool
+	ProxyJump             string // empty if none
+	ProxyCommand          string // empty if none
+	ControlPath           string // empty if none
+
+	PreferredAuthentications []string // in order, unknown ones included
+	NumberOfPasswordPrompts  int
+}
+
+func (self *SshHost) String() string {
+	return fmt.Sprintf("%s (%s@%s:%s)", self.Name, self.User, self.HostName, self.Port)
+}
+
+// expands %%, %C, %d, %h, %i, %j, %L, %l, %n, %p, %r and %u as OpenSSH does
+func ExpandSshTokens(text, host, port, remote, alias, jump string) string {
+	local, _ := os.Hostname()
+	short := strings.SplitN(local, ".", 2)[0]
+	me := ""
+	if u, err := user.Current(); err == nil {
+		me = u.Username
+	}
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(local+host+port+remote+jump)))
+	return strings.NewReplacer(
+		"%%", "%",
+		"%C", hash,
+		"%d", os.Getenv("HOME"),
+		"%h", host,
+		"%i", fmt.Sprint(os.Getuid()),
+		"%j", jump,
+		"%L", short,
+		"%l", local,
+		"%n", alias,
+		"%p", port,
+		"%r", remote,
+		"%u", me,
+	).Replace(text)
+}
+
+var env_re = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// "${HOME}/x" -> "/home/me/x", no bare $HOME as OpenSSH has it
+func ExpandEnv(text string) string {
+	return env_re.ReplaceAllStringFunc(text, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Warn("No $%s for %q", name, text)
+		}
+		return value
+	})
+}
+
+// for IdentityFile and the like: ~, ${ENV} and %-tokens
+func (self *SshHost) expandPath(path string) string {
+	remote := self.User
+	if remote == "" {
+		if u, err := user.Current(); err == nil {
+			remote = u.Username
+		}
+	}
+	return ExpandHome(ExpandSshTokens(ExpandEnv(path),
+		self.HostName, self.Port, remote, self.Name, self.ProxyJump))
+}
+
+func sshSeconds(host, name, value string) (time.Duration, error) {
+	if value == "" || value == "none" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: bad %s %q", host, name, value)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// the sections applying to the host are merged once, then all is read from that
+func ResolveSshHost(cf *SshConfig, host string) (*SshHost, error) {
+	var err error
+	entry, names := cf.merge(host)
+	log.Debug("Host %q: %q", host, names)
+	h := SshHost{
+		Name:     host,
+		HostName: strings.Replace(entry.GetValue("HostName", host), "%h", host, -1),
+		User:     entry.GetValue("User", ""),
+		Port:     entry.GetValue("Port", DefaultSshPort),
+	}
+
+	if jump := entry.GetValue("ProxyJump", "none"); jump != "none" {
+		h.ProxyJump = jump
+	}
+
+	files, _ := entry.GetAll("IdentityFile")
+	for _, file := range files {
+		if path := h.expandPath(file); file != "none" && !ContainsString(h.IdentityFiles, path) {
+			h.IdentityFiles = append(h.IdentityFiles, path)
+		}
+	}
+	files, _ = entry.GetAll("CertificateFile")
+	for _, file := range files {
+		if path := h.expandPath(file); file != "none" && !ContainsString(h.CertificateFiles, path) {
+			h.CertificateFiles = append(h.CertificateFiles, path)
+		}
+	}
+	h.IdentitiesOnly = strings.EqualFold(entry.GetValue("IdentitiesOnly", "no"), "yes")
+	files, _ = entry.GetArgs("UserKnownHostsFile")
+	h.NoUserKnownHosts = ContainsString(files, "none")
+	for _, file := range files {
+		if !h.NoUserKnownHosts {
+			h.UserKnownHostsFiles = append(h.UserKnownHostsFiles, h.expandPath(file))
+		}
+	}
+
+	h.ConnectTimeout, err = sshSeconds(host, "ConnectTimeout",
+		entry.GetValue("ConnectTimeout", ""))
+	if err != nil {
+		return nil, err
+	}
+	h.ServerAliveInterval, err = sshSeconds(host, "ServerAliveInterval",
+		entry.GetValue("ServerAliveInterval", ""))
+	if err != nil {
+		return nil, err
+	}
+	count := entry.GetValue("ServerAliveCountMax", strconv.Itoa(DefaultServerAliveCountMax))
+	h.ServerAliveCountMax, err = strconv.Atoi(count)
+	if err != nil || h.ServerAliveCountMax < 0 {
+		return nil, fmt.Errorf("%s: bad ServerAliveCountMax %q", host, count)
+	}
+
+	for _, method := range strings.Split(entry.GetValue("PreferredAuthentications",
+		DefaultPreferredAuthentications), ",") {
+		h.PreferredAuthentications = append(h.PreferredAuthentications, strings.TrimSpace(method))
+	}
+	prompts := entry.GetValue("NumberOfPasswordPrompts", strconv.Itoa(DefaultPasswordPrompts))
+	h.NumberOfPasswordPrompts, err = strconv.Atoi(prompts)
+	if err != nil || h.NumberOfPasswordPrompts < 0 {
+		return nil, fmt.Errorf("%s: bad NumberOfPasswordPrompts %q", host, prompts)
+	}
+
+	// the values are case-insensitive, as OpenSSH has them
+	switch check := entry.GetValue("StrictHostKeyChecking", HostKeyCheckAsk); strings.ToLower(check) {
+	case "yes", "true":
+		h.StrictHostKeyChecking = HostKeyCheckYes
+	case "no", "off", "false":
+		h.StrictHostKeyChecking = HostKeyCheckNo
+	case "ask":
+		h.StrictHostKeyChecking = HostKeyCheckAsk
+	case "accept-new":
+		h.StrictHostKeyChecking = HostKeyCheckAcceptNew
+	default:
+		return nil, fmt.Errorf("%s: bad StrictHostKeyChecking %q", host, check)
+	}
+
+	files, ok := entry.GetArgs("GlobalKnownHostsFile")
+	if !ok {
+		files = []string{SystemSshKnownHosts}
+	}
+	for _, file := range files {
+		if file != "none" {
+			h.GlobalKnownHostsFiles = append(h.GlobalKnownHostsFiles, h.expandPath(file))
+		}
+	}
+	h.HashKnownHosts = strings.EqualFold(entry.GetValue("HashKnownHosts", "no"), "yes")
+
+	switch fwd := entry.GetValue("ForwardAgent", "no"); strings.ToLower(fwd) {
+	case "no", "false":
+	default: // "yes" or an agent socket path
+		h.ForwardAgent = true
+	}
+
+	if command := entry.GetValue("ProxyCommand", "none"); command != "none" {
+		h.ProxyCommand = command
+	}
+	if path := entry.GetValue("ControlPath", "none"); path != "none" {
+		h.ControlPath = path
+	}
+
+	log.Debug("Host %q resolved to %s", host, h.String())
+	return &h, nil
+}
+
+/* EOF */
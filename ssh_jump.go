@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*============================================================================*/
+
+// a chain of jump hosts, resolved to the pool key of its last hop
+type jumpHost struct {
+	sync.Mutex
+	key string // empty until connected
+}
+
+var jumps = struct {
+	sync.Mutex
+	hosts map[string]*jumpHost // keyed by the chain up to this hop, "a,b"
+}{hosts: make(map[string]*jumpHost)}
+
+// "a, b ,c" -> ["a" "b" "c"]
+func ParseJump(spec string) (chain []string) {
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop != "" {
+			chain = append(chain, hop)
+		}
+	}
+	return
+}
+
+// "[ssh://][user@]host[:port]" -> user, host, port
+func splitHop(hop string) (user, host, port string) {
+	host = strings.TrimPrefix(hop, "ssh://")
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		user, host = host[:at], host[at+1:]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	return
+}
+
+// returns a client connected to the last hop of the chain through the others
+func JumpClient(id int, chain []string, timeout time.Duration) (*ssh.Client, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty jump chain")
+	}
+	key := strings.Join(chain, ",")
+
+	jumps.Lock()
+	jh, ok := jumps.hosts[key]
+	if !ok {
+		jh = new(jumpHost)
+		jumps.hosts[key] = jh
+	}
+	jumps.Unlock()
+
+	jh.Lock()
+	defer jh.Unlock()
+	if jh.key != "" {
+		if client := PoolLookup(jh.key); client != nil {
+			return client, nil
+		}
+	}
+
+	user, host, port := splitHop(chain[len(chain)-1])
+	cx, err := NewContext(id, host, false, user)
+	if err != nil {
+		return nil, err
+	}
+	if port != "" {
+		if err = cx.SetPort(port); err != nil {
+			return nil, err
+		}
+	}
+	if timeout > 0 {
+		cx.ConnectTimeout = timeout
+	}
+	cx.Jump = strings.Join(chain[:len(chain)-1], ",")
+
+	log.Debug("[%d] Connecting to jump host %q", id, key)
+	jh.key = cx.poolKey()
+	client, _, err := PoolClient(jh.key, cx.dial)
+	return client, err
+}
+
+/* EOF */
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// "jump: admin@bastion:2222" has its host key as [bastion]:2222
+func TestSetPort(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "known_hosts")
+	err = os.WriteFile(name, append([]byte("[bastion]:2222 "), ssh.MarshalAuthorizedKey(pub)...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cx := &Context{Port: DefaultSshPort, Settings: &SshHost{HostName: "bastion", UserKnownHostsFiles: []string{name}}}
+	cx.Ssh.ClientConfig = &ssh.ClientConfig{}
+	if err := cx.SetPort("2222"); err != nil {
+		t.Fatal(err)
+	}
+	if algos := cx.Ssh.ClientConfig.HostKeyAlgorithms; len(algos) == 0 || algos[0] != ssh.KeyAlgoRSASHA512 {
+		t.Errorf("got %q, the known rsa key first", algos)
+	}
+}
+
+/* EOF */
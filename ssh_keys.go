@@ -1,65 +1,202 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 
+	"github.com/juju/fslock"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
-// now returns empty passphrase
-func AskPass(prompt string) []byte {
-	// os.Stderr.Write([]byte("\n" + prompt + ": "))
-	return []byte("")
+// SSH_ASKPASS_REQUIRE values
+const (
+	AskPassNever  = "never"
+	AskPassPrefer = "prefer"
+	AskPassForce  = "force"
+)
+
+const PassphraseTries = 3
+
+var lock_askpass sync.Mutex // one prompt at a time
+
+// asks /dev/tty with no echo, or SSH_ASKPASS when there is no tty or it is required
+func AskPass(prompt string) ([]byte, error) {
+	lock_askpass.Lock()
+	defer lock_askpass.Unlock()
+
+	askpass := os.Getenv("SSH_ASKPASS")
+	require := os.Getenv("SSH_ASKPASS_REQUIRE")
+	if askpass != "" && require != AskPassNever {
+		if require == AskPassForce || require == AskPassPrefer || !HaveTty() {
+			return askPassProgram(askpass, prompt)
+		}
+	}
+	if require == AskPassForce {
+		return nil, errors.New("SSH_ASKPASS_REQUIRE=force but no SSH_ASKPASS")
+	}
+	return askPassTty(prompt)
+}
+
+func HaveTty() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
 }
 
-func LoadPrivateKey() ssh.Signer {
-	id_rsa := FindSshPvtKeyFile("")
-	if id_rsa == "" {
-		log.Warn("No private key file here")
-		return nil
+func askPassTty(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot ask for passphrase: %v", err)
 	}
-	pem, err := ioutil.ReadFile(id_rsa)
+	defer tty.Close()
+	tty.WriteString(prompt)
+	pass, err := term.ReadPassword(int(tty.Fd()))
+	tty.WriteString("\n")
+	return pass, err
+}
+
+func askPassProgram(askpass, prompt string) ([]byte, error) {
+	out, err := exec.Command(askpass, prompt).Output()
 	if err != nil {
-		log.Fatal("Cannot read %q: %v", id_rsa, err)
+		return nil, fmt.Errorf("%s: %v", askpass, err)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// a key is decrypted (or given up) once per process
+type cachedKey struct {
+	sync.Mutex
+	done   bool
+	signer ssh.Signer
+	err    error
+}
+
+var keys = struct {
+	sync.Mutex
+	files map[string]*cachedKey
+}{files: make(map[string]*cachedKey)}
+
+// nil signer with no error means the user declined to give the passphrase
+func LoadPrivateKey(path string) (ssh.Signer, error) {
+	keys.Lock()
+	ck, ok := keys.files[path]
+	if !ok {
+		ck = new(cachedKey)
+		keys.files[path] = ck
+	}
+	keys.Unlock()
+
+	ck.Lock()
+	defer ck.Unlock()
+	if !ck.done {
+		ck.signer, ck.err = loadPrivateKey(path)
+		ck.done = true
+	}
+	return ck.signer, ck.err
+}
+
+func loadPrivateKey(path string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %q: %v", path, err)
 	}
 	sgn, err := ssh.ParsePrivateKey(pem)
 	if err == nil {
-		return sgn
+		return sgn, nil
 	}
-	switch err.(type) {
-	case *ssh.PassphraseMissingError:
-		pass := AskPass(id_rsa)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return nil, fmt.Errorf("Cannot parse %q: %v", path, err)
+	}
+	prompt := fmt.Sprintf("Enter passphrase for key '%s': ", path)
+	for try := 1; try <= PassphraseTries; try++ {
+		pass, err := AskPass(prompt)
+		if err != nil {
+			return nil, err
+		}
+		if len(pass) == 0 {
+			log.Info("Skipping key %q", path)
+			return nil, nil
+		}
 		sgn, err = ssh.ParsePrivateKeyWithPassphrase(pem, pass)
 		if err == nil {
-			return sgn
+			return sgn, nil
+		}
+		if err != x509.IncorrectPasswordError {
+			return nil, fmt.Errorf("Cannot decrypt %q: %v", path, err)
+		}
+		prompt = fmt.Sprintf("Bad passphrase, try again for '%s': ", path)
+	}
+	return nil, fmt.Errorf("Bad passphrase for %q, %d tries", path, PassphraseTries)
+}
+
+func LoadCertificate(path string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %q: %v", path, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse %q: %v", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a certificate but %s", path, pub.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%q is not a user certificate", path)
+	}
+	return cert, nil
+}
+
+// a signer matching a certificate is offered with it first, then as is
+func WithCertificates(signers []ssh.Signer, certs []*ssh.Certificate) (list []ssh.Signer) {
+	for _, signer := range signers {
+		for _, cert := range certs {
+			if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+				continue
+			}
+			cs, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				log.Warn("Certificate %q: %v", cert.KeyId, err)
+				continue
+			}
+			list = append(list, cs)
 		}
-		return nil
+		list = append(list, signer)
 	}
-	log.Fatal("Cannot parse %q: %v", id_rsa, err)
-	return nil
+	return
 }
 
-func LoadPublicKey() ssh.PublicKey {
-	id_rsa := FindSshPubKeyFile("")
-	if id_rsa == "" {
-		log.Warn("No public key file here")
-		return nil
+// nil if there is no such file
+func LoadPublicKey(path string) (ssh.PublicKey, error) {
+	if !FileExists(path) {
+		return nil, nil
 	}
-	pem, err := ioutil.ReadFile(id_rsa)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Cannot read %q: %v", id_rsa, err)
+		return nil, fmt.Errorf("Cannot read %q: %v", path, err)
 	}
-	pub, err := ssh.ParsePublicKey(pem)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
 	if err != nil {
-		log.Fatal("Cannot parse %q: %v", id_rsa, err)
+		return nil, fmt.Errorf("Cannot parse %q: %v", path, err)
 	}
-	return pub
+	return pub, nil
 }
 
 func sha1hmac(salt, text string) string {
@@ -68,69 +205,93 @@ func sha1hmac(salt, text string) string {
 	return string(mac.Sum(nil))
 }
 
-func unbase64(text string) string {
+func unbase64(text string) (string, error) {
 	res, err := base64.StdEncoding.DecodeString(text)
 	if err != nil {
-		log.Fatal("Cannot unbase64 %q: %v", text, err)
+		return "", fmt.Errorf("Cannot unbase64 %q: %v", text, err)
 	}
-	return string(res)
+	return string(res), nil
 }
 
-func IsHostKeyEntry(host, entry string) bool {
+func IsHostKeyEntry(host, entry string) (bool, error) {
 	if !strings.HasPrefix(entry, "|") {
-		return host == entry
+		return host == entry, nil
 	}
 	fx := strings.Split(entry, "|")
-	if len(fx[0]) != 0 {
-		log.Fatal("Bad format %q", entry)
+	if len(fx) < 4 {
+		return false, fmt.Errorf("Bad format %q", entry)
 	}
 	switch fx[1] {
 	case "1": // |1|<salt>|<hash>|... // https://habr.com/en/post/421477/
-		salt, hash := unbase64(fx[2]), unbase64(fx[3])
-		return hash == sha1hmac(salt, host)
-	default:
-		log.Fatal("Unknown hash %q in %q", fx[1], entry)
+		salt, err := unbase64(fx[2])
+		if err != nil {
+			return false, err
+		}
+		hash, err := unbase64(fx[3])
+		if err != nil {
+			return false, err
+		}
+		return hash == sha1hmac(salt, host), nil
 	}
-	return false // never reached
+	return false, fmt.Errorf("Unknown hash %q in %q", fx[1], entry)
 }
 
-func FindHostKey(path, host string) ssh.PublicKey {
-	// https://github.com/Nokta-strigo/known_hosts_parser
-	kh, err := os.Open(path)
+// |1|<salt>|<hash>
+func HashHostName(host string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	_, err := rand.Read(salt)
 	if err != nil {
-		log.Fatal("Cannot open %q: %v", path, err)
+		return "", err
 	}
-	defer kh.Close()
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) +
+		"|" + base64.StdEncoding.EncodeToString([]byte(sha1hmac(string(salt), host))), nil
+}
 
-	scanner := bufio.NewScanner(kh)
-	ln := 0
-	for scanner.Scan() {
-		ln += 1
-		line := scanner.Text()
-		if IsCommentOrBlank(line) {
-			continue
-		}
-		if strings.HasPrefix(line, "@") {
-			word := strings.Split(line, " ")
-			log.Debug("%3d: marker %q", ln, word[0])
-			line = strings.Join(word[1:], " ")
-		}
-		word := strings.Split(line, " ")
-		cmnt := ""
-		if len(word) > 3 {
-			cmnt = " [" + strings.Join(word[3:], " ") + "]"
-		}
-		if IsHostKeyEntry(host, word[0]) {
-			hostKey, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
-			if err != nil {
-				log.Fatal("Error parsing %v: %v", word, err)
-			}
-			log.Debug("Found %q key for host %q at line %d%s",
-				word[1], host, ln, cmnt)
-			return hostKey
+var lock_known_hosts sync.Mutex // fslock does not guard against ourselves
+
+// appends the key for the host to the known hosts file, unless it's there
+func AddHostKey(path, host string, key ssh.PublicKey, hash bool) error {
+	lock_known_hosts.Lock()
+	defer lock_known_hosts.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	lock := fslock.New(path)
+	err = lock.LockWithTimeout(LOCK_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("Cannot lock %q: %v", path, err)
+	}
+	defer lock.Unlock()
+
+	known, err := LoadKnownHosts(path)
+	if err != nil {
+		return err
+	}
+	if ContainsKey(known.HostKeys(host), key) {
+		return nil // someone was faster
+	}
+
+	name := host
+	if hash {
+		name, err = HashHostName(host)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	line := name + " " + string(ssh.MarshalAuthorizedKey(key)) // it has "\n" already
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 /* EOF */
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*============================================================================*/
+
+// known_hosts markers
+const (
+	MarkerCertAuthority = "cert-authority"
+	MarkerRevoked       = "revoked"
+)
+
+// host key algorithms we can check with no CA in place
+var PlainHostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// to offer when there is a CA to check them against
+var CertHostKeyAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+}
+
+// a known_hosts line
+type KnownHostsEntry struct {
+	File    string
+	Line    int
+	Marker  string   // empty for plain host keys
+	Hosts   []string // patterns or a hash
+	Key     ssh.PublicKey
+	Comment string
+}
+
+// host is either "name" or "[name]:port"
+func (self *KnownHostsEntry) Match(host string) bool {
+	host = strings.ToLower(host)
+	if len(self.Hosts) == 1 && strings.HasPrefix(self.Hosts[0], "|") {
+		ok, err := IsHostKeyEntry(host, self.Hosts[0])
+		if err != nil {
+			log.Debug("%s:%d: %v", self.File, self.Line, err)
+		}
+		return ok
+	}
+	var patterns []string
+	for _, pattern := range self.Hosts {
+		patterns = append(patterns, strings.ToLower(pattern))
+	}
+	return MatchPatternList(host, patterns)
+}
+
+// any of the patterns matches, and none of the "!negated" ones does
+func MatchPatternList(s string, patterns []string) bool {
+	found := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		if !MatchPattern(s, pattern) {
+			continue
+		}
+		if negate {
+			return false // a negated match wins
+		}
+		found = true
+	}
+	return found
+}
+
+// OpenSSH style wildcards: '*' is any run, '?' is any single char
+func MatchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchPattern(s[i:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return len(s) == 0
+}
+
+/*============================================================================*/
+
+type KnownHosts struct {
+	files   []string
+	entries []*KnownHostsEntry
+}
+
+// bad lines are skipped, as OpenSSH does
+func LoadKnownHosts(files ...string) (*KnownHosts, error) {
+	db := &KnownHosts{files: files}
+	for _, file := range files {
+		err := db.load(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (self *KnownHosts) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	ln := 0
+	for scanner.Scan() {
+		ln += 1
+		line := scanner.Bytes()
+		if IsCommentOrBlank(string(line)) {
+			continue
+		}
+		marker, hosts, key, comment, _, err := ssh.ParseKnownHosts(line)
+		if err != nil {
+			log.Warn("%s:%d: %v", file, ln, err)
+			continue
+		}
+		self.entries = append(self.entries, &KnownHostsEntry{
+			File:    file,
+			Line:    ln,
+			Marker:  marker,
+			Hosts:   hosts,
+			Key:     key,
+			Comment: comment,
+		})
+	}
+	log.Debug("Loaded %d known hosts entries from %q", len(self.entries), file)
+	return scanner.Err()
+}
+
+func (self *KnownHosts) Files() []string {
+	return self.files
+}
+
+func (self *KnownHosts) lookup(host, marker string) (keys []ssh.PublicKey) {
+	if self == nil {
+		return
+	}
+	for _, e := range self.entries {
+		if e.Marker == marker && e.Match(host) {
+			log.Debug("%s:%d: %q %s key for %q", e.File, e.Line, e.Marker, e.Key.Type(), host)
+			keys = append(keys, e.Key)
+		}
+	}
+	return
+}
+
+// all the plain keys known for the host
+func (self *KnownHosts) HostKeys(host string) []ssh.PublicKey {
+	return self.lookup(host, "")
+}
+
+func (self *KnownHosts) Authorities(host string) []ssh.PublicKey {
+	return self.lookup(host, MarkerCertAuthority)
+}
+
+func (self *KnownHosts) IsRevoked(host string, key ssh.PublicKey) bool {
+	return ContainsKey(self.lookup(host, MarkerRevoked), key)
+}
+
+// the algorithms of the keys we know for the host go first
+func (self *KnownHosts) Algorithms(host string) (list []string) {
+	var add = func(algos ...string) {
+		for _, algo := range algos {
+			if !ContainsString(list, algo) {
+				list = append(list, algo)
+			}
+		}
+	}
+	if len(self.Authorities(host)) > 0 {
+		add(CertHostKeyAlgorithms...)
+	}
+	for _, key := range self.HostKeys(host) {
+		if key.Type() == ssh.KeyAlgoRSA {
+			add(ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		add(key.Type())
+	}
+	add(PlainHostKeyAlgorithms...)
+	return
+}
+
+func ContainsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func ContainsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+/* EOF */
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+)
+
+/*============================================================================*/
+
+const MatchSection = "Match"
+
+// a "Match ..." section name, not a host pattern
+func IsMatchSection(name string) bool {
+	return strings.HasPrefix(name, MatchSection+" ")
+}
+
+type sshCriterion struct {
+	negate bool
+	kind   string   // all, canonical, final, exec, host, localuser, originalhost, user
+	args   []string // patterns, or the command for exec
+}
+
+// a "Match" line, all the criteria must hold
+type SshMatch struct {
+	line     string
+	criteria []sshCriterion
+}
+
+func ParseSshMatch(line string) (*SshMatch, error) {
+	m := &SshMatch{line: line}
+	words, err := SplitQuoted(strings.TrimSpace(strings.TrimPrefix(line, MatchSection)))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", line, err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%q: no criteria", line)
+	}
+	for len(words) > 0 {
+		c := sshCriterion{kind: strings.ToLower(words[0])}
+		words = words[1:]
+		if strings.HasPrefix(c.kind, "!") {
+			c.negate, c.kind = true, c.kind[1:]
+		}
+		switch c.kind {
+		case "all", "canonical", "final":
+		case "exec":
+			if len(words) == 0 {
+				return nil, fmt.Errorf("%q: %s needs an argument", line, c.kind)
+			}
+			c.args, words = words[:1], words[1:]
+		case "host", "originalhost", "user", "localuser":
+			if len(words) == 0 {
+				return nil, fmt.Errorf("%q: %s needs an argument", line, c.kind)
+			}
+			c.args, words = strings.Split(words[0], ","), words[1:]
+		default:
+			return nil, fmt.Errorf("%q: unsupported criterion %q", line, c.kind)
+		}
+		m.criteria = append(m.criteria, c)
+	}
+	return m, nil
+}
+
+func (self *SshMatch) String() string {
+	return self.line
+}
+
+// a "final" criterion asks for one more pass over the config
+func (self *SshMatch) WantsFinal() bool {
+	for _, c := range self.criteria {
+		if c.kind == "final" {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *SshMatch) Match(mc *SshMatchContext) bool {
+	for _, c := range self.criteria {
+		if c.match(mc) == c.negate {
+			return false
+		}
+	}
+	log.Debug("%q matched %q", self.line, mc.Original)
+	return true
+}
+
+func (c *sshCriterion) match(mc *SshMatchContext) bool {
+	mc.resolve()
+	switch c.kind {
+	case "all":
+		return true
+	case "canonical", "final":
+		return mc.final // no canonicalization here, so it's the final pass only
+	case "exec":
+		return matchExec(ExpandSshTokens(c.args[0], mc.host, mc.port, mc.user, mc.Original, ""))
+	case "host":
+		return MatchPatternList(strings.ToLower(mc.host), lowered(c.args))
+	case "originalhost":
+		return MatchPatternList(strings.ToLower(mc.Original), lowered(c.args))
+	case "user":
+		return MatchPatternList(mc.user, c.args)
+	case "localuser":
+		return MatchPatternList(mc.local, c.args)
+	}
+	return false
+}
+
+func lowered(list []string) (res []string) {
+	for _, s := range list {
+		res = append(res, strings.ToLower(s))
+	}
+	return
+}
+
+type matchExecResult struct {
+	once sync.Once
+	ok   bool
+}
+
+var match_exec = struct {
+	sync.Mutex
+	done map[string]*matchExecResult
+}{done: make(map[string]*matchExecResult)}
+
+// each command is run once per process, with no stdin or stdout as OpenSSH has it;
+// the lock is held only for the same command, not for all of them
+func matchExec(command string) bool {
+	match_exec.Lock()
+	r, found := match_exec.done[command]
+	if !found {
+		r = new(matchExecResult)
+		match_exec.done[command] = r
+	}
+	match_exec.Unlock()
+	r.once.Do(func() {
+		cmd := exec.Command("bash", "-c", command) // Stdin and Stdout are /dev/null if nil
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		log.Debug("Match exec %q: %v", command, err)
+		r.ok = err == nil
+	})
+	return r.ok
+}
+
+/*============================================================================*/
+
+// what the Match criteria are checked against, resolved once needed
+type SshMatchContext struct {
+	known    *SshConfigFileEntry // from the sections before the Match
+	Original string              // the host as given
+	host     string              // after HostName
+	user     string              // remote
+	port     string
+	local    string // local user
+	final    bool   // the second pass, see SshMatch.WantsFinal
+	resolved bool
+}
+
+func NewSshMatchContext(host string, known *SshConfigFileEntry, final bool) *SshMatchContext {
+	return &SshMatchContext{known: known, Original: host, final: final}
+}
+
+func (self *SshMatchContext) resolve() {
+	if self.resolved {
+		return
+	}
+	self.resolved = true
+	self.host, self.port = self.Original, DefaultSshPort
+	if u, err := user.Current(); err == nil {
+		self.local = u.Username
+	}
+	self.user = self.local
+	if v, ok := self.known.Get("HostName"); ok {
+		self.host = strings.Replace(v, "%h", self.Original, -1)
+	}
+	if v, ok := self.known.Get("User"); ok {
+		self.user = v
+	}
+	if v, ok := self.known.Get("Port"); ok {
+		self.port = v
+	}
+}
+
+/*============================================================================*/
+
+// splits the words as OpenSSH does: "double" or 'single' quoted ones are kept
+// together, \" \' \\ and (unquoted) "\ " are escapes, a word starting with # ends it all
+func SplitQuoted(line string) (words []string, err error) {
+	s := []rune(line)
+	for i := 0; i < len(s); {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i == len(s) || s[i] == '#' {
+			break
+		}
+		var word strings.Builder
+		var quote rune // the one the word is in, if any
+	next:
+		for ; i < len(s); i++ {
+			switch r := s[i]; {
+			case r == '\\' && i+1 < len(s) &&
+				(strings.ContainsRune(`"'\`, s[i+1]) || quote == 0 && s[i+1] == ' '):
+				i++
+				word.WriteRune(s[i])
+			case quote == 0 && (r == ' ' || r == '\t'):
+				break next
+			case quote == 0 && (r == '"' || r == '\''):
+				quote = r
+			case r == quote:
+				quote = 0
+			default:
+				word.WriteRune(r)
+			}
+		}
+		if quote != 0 {
+			return nil, errors.New("unterminated quote")
+		}
+		words = append(words, word.String())
+	}
+	return
+}
+
+/* EOF */
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatchExec(t *testing.T) {
+	if !matchExec("true") || matchExec("false") {
+		t.Error("exit status is not the match")
+	}
+	if matchExec("read line") { // no stdin, so EOF
+		t.Error("Match exec has read stdin")
+	}
+
+	// different commands do not wait for one another
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for _, command := range []string{"sleep 0.3; true", "sleep 0.3; :"} {
+		wg.Add(1)
+		go func(command string) {
+			defer wg.Done()
+			matchExec(command)
+		}(command)
+	}
+	wg.Wait()
+	if dt := time.Since(start); dt > 550*time.Millisecond {
+		t.Errorf("took %s, run one by one", dt)
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want []string // nil for an error
+	}{
+		{`a  b`, []string{"a", "b"}},
+		{`"a b" c`, []string{"a b", "c"}},
+		{`'a "b"' c`, []string{`a "b"`, "c"}},
+		{`"a 'b'"`, []string{"a 'b'"}},
+		{`a\ b \\c`, []string{"a b", `\c`}},
+		{`"a\"b" 'c\'d'`, []string{`a"b`, "c'd"}},
+		{`a\x`, []string{`a\x`}},
+		{`"" x`, []string{"", "x"}},
+		{`a # b c`, []string{"a"}},
+		{`a#b "#c"`, []string{"a#b", "#c"}},
+		{`# all of it`, []string{}},
+		{`"a b`, nil},
+		{`'a`, nil},
+	} {
+		got, err := SplitQuoted(c.line)
+		switch {
+		case c.want == nil && err == nil:
+			t.Errorf("%s: got %q, want an error", c.line, got)
+		case c.want != nil && (err != nil || fmt.Sprintf("%q", got) != fmt.Sprintf("%q", c.want)):
+			t.Errorf("%s: got %q (%v), want %q", c.line, got, err, c.want)
+		}
+	}
+}
+
+// "Match final" is taken in the second pass only, against the HostName
+func TestMatchFinal(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(name, []byte(`Host db
+    HostName %h.internal
+Match final host db.internal
+    User admin
+Match !final
+    Port 2222
+Match final
+    Port 22
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := NewSshConfig(name)
+	for _, c := range [][2]string{{"user", "admin"}, {"port", "2222"}} {
+		if got := cf.GetValue("db", c[0], ""); got != c[1] {
+			t.Errorf("%s: got %q, want %q", c[0], got, c[1])
+		}
+	}
+}
+
+/* EOF */
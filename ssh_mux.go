@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*============================================================================*/
+
+// OpenSSH ControlMaster protocol, see PROTOCOL.mux
+const (
+	MuxVersion = 4
+
+	muxMsgHello                = 0x00000001
+	muxNewSession              = 0x10000002
+	muxPermissionDenied        = 0x80000002
+	muxFailure                 = 0x80000003
+	muxExitMessage             = 0x80000004
+	muxSessionOpened           = 0x80000006
+	muxTtyAllocFail            = 0x80000008
+	muxNoEscapeChar     uint32 = 0xfffffffe
+)
+
+// non-zero exit status of a command run over a master
+type MuxExitError struct {
+	Status int
+}
+
+func (e *MuxExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.Status)
+}
+
+/*----------------------------------------------------------------------------*/
+
+type muxMessage []byte
+
+func (m muxMessage) u32(v uint32) muxMessage {
+	return append(m, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+func (m muxMessage) str(s string) muxMessage {
+	return append(m.u32(uint32(len(s))), s...)
+}
+
+type muxReply struct {
+	data []byte
+	err  error
+}
+
+func (r *muxReply) u32() (v uint32) {
+	if r.err != nil {
+		return
+	}
+	if len(r.data) < 4 {
+		r.err = errors.New("mux: short message")
+		return
+	}
+	v, r.data = binary.BigEndian.Uint32(r.data), r.data[4:]
+	return
+}
+func (r *muxReply) str() (s string) {
+	n := r.u32()
+	if r.err != nil {
+		return
+	}
+	if uint32(len(r.data)) < n {
+		r.err = errors.New("mux: short string")
+		return
+	}
+	s, r.data = string(r.data[:n]), r.data[n:]
+	return
+}
+
+/*============================================================================*/
+
+// a connection to a ControlMaster, good for a single session
+type MuxClient struct {
+	path string
+	conn *net.UnixConn
+}
+
+func DialMux(path string) (*MuxClient, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	mux := &MuxClient{path: path, conn: conn}
+	err = mux.send(muxMessage(nil).u32(muxMsgHello).u32(MuxVersion))
+	if err == nil {
+		err = mux.hello()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mux %q: %v", path, err)
+	}
+	return mux, nil
+}
+
+func (self *MuxClient) hello() error {
+	r, err := self.recv()
+	if err != nil {
+		return err
+	}
+	kind, version := r.u32(), r.u32()
+	if r.err != nil {
+		return r.err
+	}
+	if kind != muxMsgHello {
+		return fmt.Errorf("expected hello, got %#x", kind)
+	}
+	if version != MuxVersion {
+		return fmt.Errorf("unsupported protocol version %d", version)
+	}
+	return nil // extensions are of no interest
+}
+
+func (self *MuxClient) Close() error {
+	return self.conn.Close()
+}
+
+func (self *MuxClient) send(m muxMessage) error {
+	_, err := self.conn.Write(append(muxMessage(nil).u32(uint32(len(m))), m...))
+	return err
+}
+
+func (self *MuxClient) recv() (*muxReply, error) {
+	var size [4]byte
+	_, err := io.ReadFull(self.conn, size[:])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err = io.ReadFull(self.conn, data)
+	if err != nil {
+		return nil, err
+	}
+	return &muxReply{data: data}, nil
+}
+
+// the master takes our stdio descriptors, one per message
+func (self *MuxClient) sendFd(f *os.File) error {
+	_, _, err := self.conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// runs the command as ssh -S would
+func (self *MuxClient) Run(command string, tty, forward bool, stdout, stderr io.Writer) error {
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer stdin.Close()
+	or, ow, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer or.Close()
+	er, ew, err := os.Pipe()
+	if err != nil {
+		ow.Close()
+		return err
+	}
+	defer er.Close()
+
+	const id = 1
+	m := muxMessage(nil).u32(muxNewSession).u32(id).str("").
+		u32(muxFlag(tty)).u32(0).u32(muxFlag(forward)).u32(0).u32(muxNoEscapeChar).
+		str(os.Getenv("TERM")).str(command)
+	err = self.send(m)
+	for _, f := range []*os.File{stdin, ow, ew} {
+		if err == nil {
+			err = self.sendFd(f)
+		}
+	}
+	ow.Close() // the master has its own copies now
+	ew.Close()
+	if err != nil {
+		return err
+	}
+
+	r, err := self.recv()
+	if err != nil {
+		return err
+	}
+	switch kind, rid := r.u32(), r.u32(); {
+	case r.err != nil:
+		return r.err
+	case rid != id:
+		return fmt.Errorf("mux: reply to %d, not %d", rid, id)
+	case kind == muxPermissionDenied:
+		return fmt.Errorf("mux: permission denied: %s", r.str())
+	case kind == muxFailure:
+		return fmt.Errorf("mux: failure: %s", r.str())
+	case kind != muxSessionOpened:
+		return fmt.Errorf("mux: unexpected reply %#x", kind)
+	}
+	log.Debug("mux %q: session %d", self.path, r.u32())
+
+	done := make(chan struct{}, 2)
+	var drain = func(w io.Writer, r *os.File) {
+		io.Copy(w, r)
+		done <- struct{}{}
+	}
+	go drain(stdout, or)
+	go drain(stderr, er)
+	status, err := self.wait()
+	if err != nil {
+		or.Close() // do not wait for the master to let them go
+		er.Close()
+	}
+	<-done
+	<-done
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return &MuxExitError{Status: status}
+	}
+	return nil
+}
+
+func (self *MuxClient) wait() (int, error) {
+	for {
+		r, err := self.recv()
+		if err != nil {
+			return 0, &ssh.ExitMissingError{} // the master dropped it
+		}
+		switch kind := r.u32(); kind {
+		case muxTtyAllocFail:
+			log.Warn("mux %q: no tty for session %d", self.path, r.u32())
+		case muxExitMessage:
+			r.u32() // session id
+			status := r.u32()
+			return int(status), r.err
+		default:
+			log.Debug("mux %q: ignored message %#x", self.path, kind)
+		}
+	}
+}
+
+func muxFlag(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*============================================================================*/
+
+func ControlPathLine(path, host, port, remote, alias, jump string) string {
+	return ExpandHome(ExpandSshTokens(ExpandEnv(path), host, port, remote, alias, jump))
+}
+
+/* EOF */
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// a ControlMaster that runs nothing: it writes "out: <command>" to stdout,
+// "err" to stderr (or a line split by one of stderr for "partial")
+// and exits with the status the command maps to, if any
+func testMuxMaster(t *testing.T, status map[string]int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "master")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				return
+			}
+			go testMuxServe(t, conn, status)
+		}
+	}()
+	return path
+}
+
+func testMuxServe(t *testing.T, conn *net.UnixConn, status map[string]int) {
+	defer conn.Close()
+	var recv = func() *muxReply {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return &muxReply{err: err}
+		}
+		data := make([]byte, binary.BigEndian.Uint32(size[:]))
+		_, err := io.ReadFull(conn, data)
+		return &muxReply{data: data, err: err}
+	}
+	var send = func(m muxMessage) {
+		conn.Write(append(muxMessage(nil).u32(uint32(len(m))), m...))
+	}
+
+	r := recv()
+	if kind, version := r.u32(), r.u32(); r.err != nil || kind != muxMsgHello || version != MuxVersion {
+		t.Errorf("master: bad hello %#x %d %v", kind, version, r.err)
+		return
+	}
+	send(muxMessage(nil).u32(muxMsgHello).u32(MuxVersion))
+
+	r = recv()
+	kind, id := r.u32(), r.u32()
+	r.str()            // reserved
+	r.u32()            // tty
+	r.u32()            // x11
+	r.u32()            // agent
+	r.u32()            // subsystem
+	escape := r.u32()  // escape char
+	r.str()            // $TERM
+	command := r.str() // the command
+	if r.err != nil || kind != muxNewSession || escape != muxNoEscapeChar {
+		t.Errorf("master: bad new session %#x %#x %v", kind, escape, r.err)
+		return
+	}
+	var stdio []*os.File
+	for i := 0; i < 3; i++ {
+		buf, oob := make([]byte, 1), make([]byte, syscall.CmsgSpace(4))
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			t.Errorf("master: fd %d: %v", i, err)
+			return
+		}
+		msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		if err != nil {
+			t.Errorf("master: fd %d: %v", i, err)
+			return
+		}
+		stdio = append(stdio, os.NewFile(uintptr(fds[0]), "stdio"))
+	}
+	var close_stdio = func() {
+		for _, f := range stdio {
+			f.Close()
+		}
+	}
+	if command == "deny" {
+		close_stdio()
+		send(muxMessage(nil).u32(muxPermissionDenied).u32(id).str("not today"))
+		return
+	}
+	send(muxMessage(nil).u32(muxSessionOpened).u32(id).u32(7))
+
+	if command == "partial" {
+		stdio[1].Write([]byte("a"))
+		stdio[2].Write([]byte("b\n"))
+		stdio[1].Write([]byte("c\n"))
+	} else {
+		stdio[1].Write([]byte("out: " + command + "\n"))
+		stdio[2].Write([]byte("err\n"))
+	}
+	close_stdio()
+	if command == "vanish" {
+		return // no exit message
+	}
+	send(muxMessage(nil).u32(muxExitMessage).u32(7).u32(uint32(status[command])))
+}
+
+func TestMuxRun(t *testing.T) {
+	path := testMuxMaster(t, map[string]int{"false": 3})
+	for _, c := range []struct {
+		command string
+		status  int  // of MuxExitError, 0 for none
+		missing bool // ExitMissingError
+		denied  bool
+	}{
+		{command: "uptime"},
+		{command: "false", status: 3},
+		{command: "vanish", missing: true},
+		{command: "deny", denied: true},
+	} {
+		mux, err := DialMux(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stdout, stderr bytes.Buffer
+		err = mux.Run(c.command, false, false, &stdout, &stderr)
+		mux.Close()
+
+		var ee *MuxExitError
+		var me *ssh.ExitMissingError
+		switch {
+		case c.denied:
+			if err == nil {
+				t.Errorf("%s: not denied", c.command)
+			}
+			continue
+		case c.missing: // the output may be gone too then
+			if !errors.As(err, &me) {
+				t.Errorf("%s: got %v, want ExitMissingError", c.command, err)
+			}
+			continue
+		case c.status != 0:
+			if !errors.As(err, &ee) || ee.Status != c.status {
+				t.Errorf("%s: got %v, want status %d", c.command, err, c.status)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", c.command, err)
+		}
+		if got, want := stdout.String(), "out: "+c.command+"\n"; got != want {
+			t.Errorf("%s: stdout %q, want %q", c.command, got, want)
+		}
+		if got := stderr.String(); got != "err\n" {
+			t.Errorf("%s: stderr %q", c.command, got)
+		}
+	}
+}
+
+// with --stream a line of stdout is not broken by one of stderr
+func TestMuxStream(t *testing.T) {
+	mux, err := DialMux(testMuxMaster(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	var buf bytes.Buffer
+	context := &Context{Stream: NewLineWriter(&buf, "h: "), StreamErr: NewLineWriter(&buf, "h: ")}
+	context.Ssh.mux = mux
+	if _, _, err := context.output("partial"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	sort.Strings(lines)
+	if want := []string{"h: ac", "h: b"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestDialMuxNoMaster(t *testing.T) {
+	if _, err := DialMux(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("dialed a master that is not there")
+	}
+}
+
+/* EOF */
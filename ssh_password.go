@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*============================================================================*/
+
+// password_from values
+const (
+	PasswordFromEnv    = "env:"   // env:VAR
+	PasswordFromFile   = "file:"  // file:path
+	PasswordFromPrompt = "prompt" // ask once for all the hosts
+)
+
+func ValidPasswordFrom(from string) error {
+	switch {
+	case from == "", from == PasswordFromPrompt:
+	case strings.HasPrefix(from, PasswordFromEnv) && len(from) > len(PasswordFromEnv):
+	case strings.HasPrefix(from, PasswordFromFile) && len(from) > len(PasswordFromFile):
+	default:
+		return fmt.Errorf("%q is not env:VAR, file:path or prompt", from)
+	}
+	return nil
+}
+
+var passwords = struct {
+	sync.Mutex
+	known map[string]string // by password_from
+}{known: make(map[string]string)}
+
+// the password is read once and shared by all the hosts; failed is the one
+// just refused, so that a prompt is repeated instead of offering it again
+func GetPassword(from, failed string) (string, error) {
+	passwords.Lock()
+	defer passwords.Unlock()
+	pw, ok := passwords.known[from]
+	if ok && !(from == PasswordFromPrompt && failed != "" && pw == failed) {
+		return pw, nil
+	}
+	pw, err := readPassword(from, ok)
+	if err != nil {
+		return "", err
+	}
+	passwords.known[from] = pw
+	return pw, nil
+}
+
+func readPassword(from string, again bool) (string, error) {
+	switch {
+	case strings.HasPrefix(from, PasswordFromEnv):
+		name := from[len(PasswordFromEnv):]
+		pw, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("No password in $%s", name)
+		}
+		return pw, nil
+	case strings.HasPrefix(from, PasswordFromFile):
+		data, err := ioutil.ReadFile(ExpandHome(from[len(PasswordFromFile):]))
+		if err != nil {
+			return "", fmt.Errorf("Cannot read password: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case from == PasswordFromPrompt:
+		prompt := "Password: "
+		if again {
+			prompt = "Permission denied, please try again: "
+		}
+		pw, err := AskPass(prompt)
+		return string(pw), err
+	}
+	return "", fmt.Errorf("Bad password_from %q", from)
+}
+
+/*============================================================================*/
+
+// "password" and "keyboard-interactive" methods, nil if no password is to be used
+func PasswordMethods(id int, from string, prompts int) map[string]ssh.AuthMethod {
+	if from == "" || prompts <= 0 {
+		return nil
+	}
+	if from != PasswordFromPrompt {
+		prompts = 1 // no use to offer the same again
+	}
+	var failed string
+	var password = func() (string, error) {
+		pw, err := GetPassword(from, failed)
+		failed = pw // if we get called again, it did not work
+		return pw, err
+	}
+	var challenge = func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		log.Debug("[%d] keyboard-interactive %q %q %q", id, name, instruction, questions)
+		answers := make([]string, len(questions))
+		var pw string
+		var asked bool
+		for i := range questions {
+			if echos[i] {
+				continue // not a password question
+			}
+			if !asked {
+				var err error
+				pw, err = password()
+				if err != nil {
+					return nil, err
+				}
+				asked = true
+			}
+			answers[i] = pw
+		}
+		return answers, nil
+	}
+	return map[string]ssh.AuthMethod{
+		AuthPassword:            ssh.RetryableAuthMethod(ssh.PasswordCallback(password), prompts),
+		AuthKeyboardInteractive: ssh.RetryableAuthMethod(ssh.KeyboardInteractive(challenge), prompts),
+	}
+}
+
+/* EOF */
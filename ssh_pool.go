@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+/*============================================================================*/
+
+// how long a pooled client may take to answer a keepalive before it's taken for dead
+const ProbeTimeout = 5 * time.Second
+
+// a connection shared by all the contexts going to the same user@host:port
+type pooledClient struct {
+	sync.Mutex
+	client    *ssh.Client
+	forwarded bool // the agent is forwarded over this client already
+}
+
+var pool = struct {
+	sync.Mutex
+	clients map[string]*pooledClient // keyed by "user@host:port"
+	order   []string                 // as connected, to close in reverse
+}{clients: make(map[string]*pooledClient)}
+
+func pooled(key string) *pooledClient {
+	pool.Lock()
+	defer pool.Unlock()
+	pc, ok := pool.clients[key]
+	if !ok {
+		pc = new(pooledClient)
+		pool.clients[key] = pc
+	}
+	return pc
+}
+
+// the live client for the key, nil if none
+func PoolLookup(key string) *ssh.Client {
+	pc := pooled(key)
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.client
+}
+
+// the client for the key, dialed unless there is one already
+func PoolClient(key string, dial func() (*ssh.Client, error)) (client *ssh.Client, reused bool, err error) {
+	pc := pooled(key)
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.client != nil {
+		log.Debug("Reusing connection to %q", key)
+		return pc.client, true, nil
+	}
+
+	client, err = dial()
+	if err != nil {
+		return nil, false, err
+	}
+	pc.client = client
+	pc.forwarded = false
+
+	pool.Lock()
+	pool.order = append(pool.order, key)
+	pool.Unlock()
+
+	go func() { // forget it once gone, so that the next one redials
+		client.Wait()
+		PoolDrop(key, client)
+		log.Debug("Connection to %q closed", key)
+	}()
+	return client, false, nil
+}
+
+// closes the client and forgets it, if it's still the pooled one
+func PoolDrop(key string, client *ssh.Client) {
+	pc := pooled(key)
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.client == client {
+		pc.client = nil
+		pc.forwarded = false
+	}
+	client.Close()
+}
+
+// any reply to a keepalive will do, even a failure
+func PoolAlive(client *ssh.Client) bool {
+	replies := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(KeepAliveRequest, true, nil)
+		replies <- err
+	}()
+	select {
+	case err := <-replies:
+		return err == nil
+	case <-time.After(ProbeTimeout):
+		return false
+	}
+}
+
+// ForwardToAgent may be done once per client only
+func PoolForwardAgent(key string, client *ssh.Client, keyring agent.Agent) error {
+	pc := pooled(key)
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.client != client || pc.forwarded {
+		return nil
+	}
+	err := agent.ForwardToAgent(client, keyring)
+	if err != nil {
+		return err
+	}
+	pc.forwarded = true
+	return nil
+}
+
+// to be called once all the jobs are done
+func ClosePool() {
+	pool.Lock()
+	order := pool.order
+	pool.order = nil
+	pool.Unlock()
+	for i := len(order) - 1; i >= 0; i-- { // the jump hosts were connected first
+		pc := pooled(order[i])
+		pc.Lock()
+		if pc.client != nil {
+			log.Debug("Closing connection to %q", order[i])
+			pc.client.Close()
+			pc.client = nil
+		}
+		pc.Unlock()
+	}
+}
+
+/* EOF */
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*============================================================================*/
+
+// ProxyCommand stdin/stdout as a net.Conn to run SSH over
+type proxyConn struct {
+	cmd  *exec.Cmd
+	once sync.Once
+	io.Reader
+	io.WriteCloser
+}
+
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "proxy" }
+func (a proxyAddr) String() string  { return string(a) }
+
+func (c *proxyConn) Close() (err error) {
+	c.once.Do(func() {
+		c.WriteCloser.Close()
+		c.cmd.Process.Kill()
+		err = c.cmd.Wait()
+		log.Debug("ProxyCommand %q: %v", c.cmd.Args, err)
+	})
+	return
+}
+
+func (c *proxyConn) LocalAddr() net.Addr                { return proxyAddr("-") }
+func (c *proxyConn) RemoteAddr() net.Addr               { return proxyAddr(strings.Join(c.cmd.Args, " ")) }
+func (c *proxyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// expands ${ENV} and the %-tokens in the ProxyCommand, as in ControlPath
+func ProxyCommandLine(command, host, port, user, alias string) string {
+	return ExpandSshTokens(ExpandEnv(command), host, port, user, alias, "")
+}
+
+func DialProxyCommand(command string) (net.Conn, error) {
+	cmd := exec.Command("bash", "-c", "exec "+command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("ProxyCommand %q", cmd.Args)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+/* EOF */
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testPassword = "secret"
+
+// an SSH server on 127.0.0.1 which takes testPassword and echoes the commands back
+func testSshServer(t *testing.T) (addr string, hostKey ssh.PublicKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != testPassword {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go testServeConn(conn, config)
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey()
+}
+
+func testServeConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				ch.Write([]byte("ran: " + exec.Command + "\n"))
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func TestProxyCommandLine(t *testing.T) {
+	t.Setenv("PROXY_TEST_JUMP", "bastion")
+	got := ProxyCommandLine("ssh -W %h:%p ${PROXY_TEST_JUMP} # %r %n 100%%", "10.0.0.1", "2222", "root", "db")
+	want := "ssh -W 10.0.0.1:2222 bastion # root db 100%"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if c := ProxyCommandLine("%C", "h", "22", "u", "a"); len(c) != 40 {
+		t.Errorf("%%C: got %q, not a sha1", c)
+	}
+}
+
+// ProxyCommand as "nc %h %p" would do, with bash's /dev/tcp for nc
+func TestDialProxyCommand(t *testing.T) {
+	addr, hostKey := testSshServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	command := ProxyCommandLine(`bash -c 'exec 3<>/dev/tcp/$0/$1; cat <&3 2>/dev/null & exec cat >&3' %h %p`,
+		host, port, "tester", "proxied")
+	conn, err := DialProxyCommand(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            "tester",
+		Auth:            []ssh.AuthMethod{ssh.Password(testPassword)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	session.Stdout = &out
+	if err := session.Run("uptime"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "ran: uptime" {
+		t.Errorf("got %q", got)
+	}
+}
+
+/* EOF */
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*============================================================================*/
+
+const (
+	ReportJson   = "json"   // one array once all is done
+	ReportNdjson = "ndjson" // one line per task as it is done
+
+	ReportOutputMax = 4096 // bytes of stdout (and of stderr) kept in a record
+)
+
+func ValidReport(format string) error {
+	switch format {
+	case "", ReportJson, ReportNdjson:
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q, not %q or %q", format, ReportJson, ReportNdjson)
+}
+
+// what is known of a task once it is done
+type ReportRecord struct {
+	Task        int        `json:"task"`
+	Job         string     `json:"job"` // the yaml file
+	Title       string     `json:"title"`
+	Host        string     `json:"host"`
+	User        string     `json:"user"`
+	Command     string     `json:"command"`
+	Ok          bool       `json:"ok"`
+	Class       string     `json:"class,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ExitStatus  int        `json:"exit_status"` // -1 if the command never finished
+	Signal      string     `json:"signal,omitempty"`
+	Attempts    []string   `json:"attempts,omitempty"`
+	Start       *time.Time `json:"start,omitempty"` // of the command, the last attempt
+	Stop        *time.Time `json:"stop,omitempty"`
+	Elapsed     float64    `json:"elapsed"`         // seconds, the retries included
+	Check       string     `json:"check,omitempty"` // ok or failed, none if not checked
+	CheckFailed []string   `json:"check_failed,omitempty"`
+	Stdout      string     `json:"stdout,omitempty"`
+	Stderr      string     `json:"stderr,omitempty"`
+	Truncated   bool       `json:"truncated,omitempty"`
+	Saved       string     `json:"saved,omitempty"` // the --save file with the output, instead of it
+
+	result *Result
+}
+
+// context is nil if the task failed before it had one; saved is the file with the output, if any
+func NewReportRecord(task int, job *Job, context *Context, res *Result, tries []string, saved string) *ReportRecord {
+	r := &ReportRecord{
+		Task:       task,
+		Job:        job.Filename,
+		Title:      job.Title,
+		Host:       res.Host,
+		User:       job.User,
+		Command:    job.Command,
+		Ok:         !res.Failed(),
+		Class:      res.Class,
+		ExitStatus: res.ExitStatus,
+		Signal:     res.Signal,
+		Attempts:   tries,
+		Elapsed:    res.Elapsed().Seconds(),
+		Saved:      saved,
+		result:     res,
+	}
+	if res.Failed() {
+		r.Error = res.Err.Error()
+	}
+	if context != nil {
+		r.User = context.User
+		if !context.Time.Start.IsZero() {
+			start, stop := context.Time.Start, context.Time.Stop
+			r.Start, r.Stop = &start, &stop
+		}
+	}
+	var ce *CheckError
+	switch {
+	case !res.Failed():
+		r.Check = "ok"
+	case errors.As(res.Err, &ce):
+		r.Check, r.CheckFailed = "failed", ce.Failed
+	}
+	if saved == "" {
+		var cut_out, cut_err bool
+		r.Stdout, cut_out = truncate(res.Stdout, ReportOutputMax)
+		r.Stderr, cut_err = truncate(res.Stderr, ReportOutputMax)
+		r.Truncated = cut_out || cut_err
+	}
+	return r
+}
+
+// the tail is the interesting part
+func truncate(s string, max int) (string, bool) {
+	if len(s) <= max {
+		return s, false
+	}
+	s = s[len(s)-max:]
+	for len(s) > 0 && !utf8.RuneStart(s[0]) {
+		s = s[1:]
+	}
+	return s, true
+}
+
+/*----------------------------------------------------------------------------*/
+
+// all the tasks of the run
+type Report struct {
+	sync.Mutex
+	format  string
+	out     io.Writer
+	tasks   int                   // next task id
+	records map[int]*ReportRecord // nil till the task is done
+}
+
+func NewReport(format string, out io.Writer) *Report {
+	return &Report{format: format, out: out, records: make(map[int]*ReportRecord)}
+}
+
+func (self *Report) NewTask() int {
+	self.Lock()
+	defer self.Unlock()
+	task := self.tasks
+	self.tasks += 1
+	self.records[task] = nil
+	return task
+}
+
+func (self *Report) Done(r *ReportRecord) {
+	self.Lock()
+	defer self.Unlock()
+	self.records[r.Task] = r
+	if self.format == ReportNdjson {
+		self.write(r, "")
+	}
+}
+
+// the hosts never run on get a record each, of ClassSkipped
+func (self *Report) Skip(job *Job, hosts []string) {
+	for _, host := range hosts {
+		res := NewResult(job.Fqdn(host)).SetError(ErrSkipped)
+		self.Done(NewReportRecord(self.NewTask(), job, nil, res, nil, ""))
+	}
+}
+
+// the skipped ones are not counted
+func (self *Report) Tasks() (n int) {
+	self.Lock()
+	defer self.Unlock()
+	for _, r := range self.records {
+		if r == nil || r.Class != ClassSkipped {
+			n += 1
+		}
+	}
+	return
+}
+
+// of the tasks listed
+func (self *Report) Failures(list []int) (failed int) {
+	self.Lock()
+	defer self.Unlock()
+	for _, t := range list {
+		if r := self.records[t]; r != nil && !r.Ok {
+			failed += 1
+		}
+	}
+	return
+}
+
+// failed tasks are counted by class too
+func (self *Report) Totals() (failed, skips int, total time.Duration, classes map[string]int) {
+	self.Lock()
+	defer self.Unlock()
+	classes = make(map[string]int)
+	for _, r := range self.records {
+		if r == nil {
+			continue
+		}
+		if r.Class == ClassSkipped {
+			skips += 1
+			continue
+		}
+		total += r.result.Elapsed()
+		if !r.Ok {
+			failed += 1
+			classes[r.Class] += 1
+		}
+	}
+	return
+}
+
+// the JSON report goes out now, the NDJSON one is out already
+func (self *Report) Close() {
+	self.Lock()
+	defer self.Unlock()
+	if self.format != ReportJson {
+		return
+	}
+	var list []*ReportRecord
+	for _, r := range self.records {
+		if r != nil {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Task < list[j].Task })
+	if list == nil {
+		list = []*ReportRecord{}
+	}
+	self.write(list, "  ")
+}
+
+func (self *Report) write(v interface{}, indent string) {
+	enc := json.NewEncoder(self.out)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		log.Error("Cannot write the report: %v", err)
+	}
+}
+
+/* EOF */
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// the hosts left once max_fail is exceeded are in the report, not only counted
+func TestReportSkip(t *testing.T) {
+	var out bytes.Buffer
+	report := NewReport(ReportNdjson, &out)
+	report.Skip(&Job{Filename: "x.yaml", Command: "uptime", Domain: "example.com"}, []string{"web", "db"})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2: %q", len(lines), out.String())
+	}
+	for i, host := range []string{"web.example.com", "db.example.com"} {
+		var r ReportRecord
+		if err := json.Unmarshal([]byte(lines[i]), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Host != host || r.Class != ClassSkipped || r.Ok || r.Task != i {
+			t.Errorf("record %d: %+v", i, r)
+		}
+	}
+	if failed, skips, _, _ := report.Totals(); failed != 0 || skips != 2 {
+		t.Errorf("%d failed, %d skipped; want 0 and 2", failed, skips)
+	}
+	if n := report.Tasks(); n != 0 {
+		t.Errorf("%d tasks, none was run", n)
+	}
+}
+
+/* EOF */
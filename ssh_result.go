@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*============================================================================*/
+
+// what kind of failure it was, to tell "ssh failed" from "command returned 1"
+const (
+	ClassOk         = ""
+	ClassConnect    = "connect"
+	ClassAuth       = "auth"
+	ClassHostKey    = "hostkey"
+	ClassTimeout    = "timeout"
+	ClassRemoteExit = "remote-exit"
+	ClassCheck      = "check"   // the command did well, its output did not
+	ClassError      = "error"   // anything else, like a bad ssh config
+	ClassSkipped    = "skipped" // not run at all, see max_fail
+)
+
+// x/crypto has no type for it
+func IsAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+func ErrorClass(err error) string {
+	var he *HostKeyError
+	var te *TimeoutError
+	switch {
+	case err == nil:
+		return ClassOk
+	case errors.As(err, &he):
+		return ClassHostKey
+	case IsAuthError(err):
+		return ClassAuth
+	case errors.As(err, &te):
+		return ClassTimeout
+	case errors.Is(err, ErrCheckFailed):
+		return ClassCheck
+	case errors.Is(err, ErrSkipped):
+		return ClassSkipped
+	case IsConnectError(err):
+		return ClassConnect
+	}
+	if _, ok := ExitStatus(err); ok {
+		return ClassRemoteExit
+	}
+	return ClassError
+}
+
+/*----------------------------------------------------------------------------*/
+
+// what a command run on a host has left behind
+type Result struct {
+	Host       string
+	Stdout     string
+	Stderr     string
+	ExitStatus int    // -1 if the command never finished
+	Signal     string // the one that killed the command, like "TERM"
+	Start      time.Time
+	Stop       time.Time
+	Err        error
+	Class      string
+}
+
+func NewResult(host string) *Result {
+	return &Result{Host: host, ExitStatus: -1}
+}
+
+// sets the class, and the exit status and signal if err carries them
+func (self *Result) SetError(err error) *Result {
+	self.Err, self.Class = err, ErrorClass(err)
+	if status, ok := ExitStatus(err); ok {
+		self.ExitStatus = status
+	}
+	var ee *ssh.ExitError
+	if errors.As(err, &ee) {
+		self.Signal = ee.Signal()
+	}
+	return self
+}
+
+func (self *Result) Failed() bool {
+	return self.Err != nil
+}
+
+func (self *Result) Elapsed() time.Duration {
+	if self.Start.IsZero() {
+		return 0
+	}
+	return self.Stop.Sub(self.Start)
+}
+
+// both streams, stderr last
+func (self *Result) Output() string {
+	if self.Stderr == "" {
+		return self.Stdout
+	}
+	if self.Stdout == "" || strings.HasSuffix(self.Stdout, "\n") {
+		return self.Stdout + self.Stderr
+	}
+	return self.Stdout + "\n" + self.Stderr
+}
+
+// like "remote-exit 1 (TERM)"
+func (self *Result) Status() string {
+	if !self.Failed() {
+		return "ok"
+	}
+	s := self.Class
+	if self.ExitStatus > 0 {
+		s += " " + strconv.Itoa(self.ExitStatus)
+	}
+	if self.Signal != "" {
+		s += " (" + self.Signal + ")"
+	}
+	return s
+}
+
+/* EOF */
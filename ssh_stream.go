@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+/*============================================================================*/
+
+var lock_stdout sync.Mutex // one whole line at a time, whoever writes it
+
+// writes whole lines only, each one prefixed; not for concurrent use
+type LineWriter struct {
+	out    io.Writer
+	prefix string
+	buf    []byte // the incomplete line
+}
+
+func NewLineWriter(out io.Writer, prefix string) *LineWriter {
+	return &LineWriter{out: out, prefix: prefix}
+}
+
+func (self *LineWriter) Write(p []byte) (int, error) {
+	self.buf = append(self.buf, p...)
+	for {
+		n := bytes.IndexByte(self.buf, '\n')
+		if n < 0 {
+			break
+		}
+		self.emit(self.buf[:n+1])
+		self.buf = self.buf[n+1:]
+	}
+	return len(p), nil // the command is not to fail for our stdout
+}
+
+// the last line, if it had no newline
+func (self *LineWriter) Flush() {
+	if len(self.buf) > 0 {
+		self.emit(append(self.buf, '\n'))
+		self.buf = nil
+	}
+}
+
+func (self *LineWriter) emit(line []byte) {
+	lock_stdout.Lock()
+	defer lock_stdout.Unlock()
+	_, err := self.out.Write(append([]byte(self.prefix), line...))
+	if err != nil {
+		log.Debug("Cannot write %q: %v", self.prefix, err)
+	}
+}
+
+// passes the writes on till detached, then drops them
+type detachWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (self *detachWriter) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.w == nil {
+		return len(p), nil
+	}
+	return self.w.Write(p)
+}
+
+// once it returns, nothing is written any more
+func (self *detachWriter) Detach() {
+	self.Lock()
+	defer self.Unlock()
+	self.w = nil
+}
+
+/* EOF */
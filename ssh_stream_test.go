@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the LineWriter is flushed while a session given up on still writes (go test -race)
+func TestDetachWriter(t *testing.T) {
+	var buf bytes.Buffer
+	lw := NewLineWriter(&buf, "p: ")
+	w := &detachWriter{w: lw}
+	wrote, stop := make(chan struct{}), make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			w.Write([]byte("x"))
+			if i == 10 {
+				close(wrote)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-wrote
+	w.Detach()
+	lw.Flush()
+	close(stop)
+	if got := buf.String(); len(got) < len("p: x\n") || got[:4] != "p: x" || got[len(got)-1] != '\n' {
+		t.Errorf("got %q", got)
+	}
+	if n, err := w.Write([]byte("y\n")); n != 2 || err != nil || bytes.Contains(buf.Bytes(), []byte("y")) {
+		t.Errorf("write after Detach: %d, %v, %q", n, err, buf.String())
+	}
+}
+
+/* EOF */
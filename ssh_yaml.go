@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,19 +21,89 @@ import (
 
 const LOCK_TIMEOUT = 500 * time.Millisecond
 
+const (
+	DefaultRetryDelay = time.Second
+	MaxRetryDelay     = time.Minute
+)
+
+// either a count like "5" or a percentage like "5%"
+type Amount string
+
+func (a Amount) Of(total int) (float64, error) {
+	s := strings.TrimSpace(string(a))
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || p < 0 {
+			return 0, fmt.Errorf("bad percentage %q", s)
+		}
+		return p * float64(total) / 100, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad amount %q", s)
+	}
+	return float64(n), nil
+}
+
+// a time.Duration which also takes a bare number, in seconds as ssh_config has it
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds float64
+	if unmarshal(&seconds) == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
 type Job struct {
 	lock     *fslock.Lock
 	Filename string
 	// YAML fillable:
-	Title    string   `yaml:"title"`   // job title
-	Command  string   `yaml:"command"` // job command
-	CheckFor string   `yaml:"check"`   // find this in output, optional
-	UseTty   bool     `yaml:"tty"`     // request ssh tty, optional
-	Domain   string   `yaml:"domain"`  // domain suffix for <hosts>
-	User     string   `yaml:"user"`    // ssh user, normally absent
-	Before   string   `yaml:"before"`  // setup command, optional
-	After    string   `yaml:"after"`   // cleanup command, optional
-	Hosts    []string `yaml:"hosts"`   // list of hosts to run the <command> on
+	Title    string `yaml:"title"`    // job title
+	Command  string `yaml:"command"`  // job command
+	CheckFor string `yaml:"check"`    // find this in output, optional
+	UseTty   bool   `yaml:"tty"`      // request ssh tty, optional
+	Domain   string `yaml:"domain"`   // domain suffix for <hosts>
+	User     string `yaml:"user"`     // ssh user, normally absent
+	Jump     string `yaml:"jump"`     // ProxyJump hosts like "bastion,next", optional
+	Before   string `yaml:"before"`   // setup command, optional
+	After    string `yaml:"after"`    // cleanup command, optional
+	Parallel int    `yaml:"parallel"` // max hosts to run on at once, optional
+	Batch    Amount `yaml:"batch"`    // hosts per wave, count or percentage, optional
+	MaxFail  Amount `yaml:"max_fail"` // failures to stop after, count or percentage, optional
+
+	PasswordFrom string `yaml:"password_from"` // env:VAR, file:path or prompt, optional
+
+	Expect     *Expect            `yaml:"expect"`      // assertions on the result, optional
+	HostExpect map[string]*Expect `yaml:"host_expect"` // host -> its own "expect:", optional
+
+	ConnectTimeout Duration `yaml:"connect_timeout"` // like "10s" or 10, optional
+	Timeout        Duration `yaml:"timeout"`         // command time limit, optional
+
+	ServerAliveInterval Duration `yaml:"server_alive_interval"`  // keepalive period, optional
+	ServerAliveCountMax int      `yaml:"server_alive_count_max"` // unanswered keepalives to give up after, optional
+
+	Retries      int      `yaml:"retries"`       // extra attempts on connection errors, optional
+	RetryDelay   Duration `yaml:"retry_delay"`   // first delay between attempts, optional
+	RetryOnExit  []int    `yaml:"retry_on_exit"` // exit codes to retry on as well, optional
+	RetryDropped bool     `yaml:"retry_dropped"` // the command may be run again if cut short, optional
+
+	Hosts []string `yaml:"hosts"` // list of hosts to run the <command> on
 }
 
 func (j *Job) Error(text string, err error) error {
@@ -51,8 +126,138 @@ func (j *Job) Unlock() {
 	}
 }
 
-func (j *Job) Check(text string) bool {
-	return j.CheckFor == "" || strings.Contains(text, j.CheckFor)
+// number of hosts in a wave, all of them unless "batch" is set
+func (j *Job) BatchSize() (int, error) {
+	if j.Batch == "" {
+		return len(j.Hosts), nil
+	}
+	n, err := j.Batch.Of(len(j.Hosts))
+	if err != nil {
+		return len(j.Hosts), err
+	}
+	if n == 0 && len(j.Hosts) > 0 {
+		return len(j.Hosts), fmt.Errorf("%q is no hosts at all", j.Batch)
+	}
+	return int(math.Ceil(n)), nil // 1% of 10 hosts is one host
+}
+
+// number of failed hosts one may tolerate, -1 if no "max_fail" set
+func (j *Job) FailLimit() (int, error) {
+	if j.MaxFail == "" {
+		return -1, nil
+	}
+	n, err := j.MaxFail.Of(len(j.Hosts))
+	if err != nil {
+		return -1, err
+	}
+	return int(math.Floor(n)), nil
+}
+
+// job settings take precedence over the command line ones
+func (j *Job) Timeouts() (connect, command time.Duration) {
+	connect, command = Config.ConnectTimeout, Config.Timeout
+	if j.ConnectTimeout > 0 {
+		connect = time.Duration(j.ConnectTimeout)
+	}
+	if j.Timeout > 0 {
+		command = time.Duration(j.Timeout)
+	}
+	return
+}
+
+// only the connection problems are worth retrying unless told otherwise
+// the command is run again only if it never started, unless told otherwise
+func (j *Job) Retryable(err error) bool {
+	var ce *ConnectError
+	if IsConnectError(err) {
+		return errors.As(err, &ce) || j.RetryDropped // or it may be half done
+	}
+	status, ok := ExitStatus(err)
+	if !ok {
+		return false
+	}
+	for _, code := range j.RetryOnExit {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// exponential backoff with jitter: somewhere in [d/2, d] for d doubling each attempt
+func (j *Job) Backoff(attempt int) time.Duration {
+	d := time.Duration(j.RetryDelay)
+	if d <= 0 {
+		d = DefaultRetryDelay
+	}
+	for i := 1; i < attempt && d < MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > MaxRetryDelay {
+		d = MaxRetryDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (j *Job) Validate() error {
+	if err := ValidPasswordFrom(j.PasswordFrom); err != nil {
+		return fmt.Errorf("password_from: %v", err)
+	}
+	if j.ConnectTimeout < 0 {
+		return fmt.Errorf("connect_timeout: %s is negative", j.ConnectTimeout)
+	}
+	if j.Timeout < 0 {
+		return fmt.Errorf("timeout: %s is negative", j.Timeout)
+	}
+	if j.ServerAliveInterval < 0 {
+		return fmt.Errorf("server_alive_interval: %s is negative", j.ServerAliveInterval)
+	}
+	if j.ServerAliveCountMax < 0 {
+		return fmt.Errorf("server_alive_count_max: %d is negative", j.ServerAliveCountMax)
+	}
+	if j.Retries < 0 {
+		return fmt.Errorf("retries: %d is negative", j.Retries)
+	}
+	if j.RetryDelay < 0 {
+		return fmt.Errorf("retry_delay: %s is negative", j.RetryDelay)
+	}
+	if _, err := j.BatchSize(); err != nil {
+		return fmt.Errorf("batch: %v", err)
+	}
+	if _, err := j.FailLimit(); err != nil {
+		return fmt.Errorf("max_fail: %v", err)
+	}
+	if err := j.Expect.Validate(); err != nil {
+		return fmt.Errorf("expect: %v", err)
+	}
+	for host, expect := range j.HostExpect {
+		if err := expect.Validate(); err != nil {
+			return fmt.Errorf("host_expect: %s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// the host's own expectations replace the job's ones;
+// the name as given first, then the one less the domain
+func (j *Job) ExpectFor(host string) *Expect {
+	if expect, ok := j.HostExpect[host]; ok {
+		return expect
+	}
+	if dom := j.Fqdn(""); dom != "" && strings.HasSuffix(host, dom) {
+		if expect, ok := j.HostExpect[strings.TrimSuffix(host, dom)]; ok {
+			return expect
+		}
+	}
+	return j.Expect
+}
+
+// the names of the failed assertions, none if all is well
+func (j *Job) Check(res *Result) (failed []string) {
+	if j.CheckFor != "" && !strings.Contains(res.Output(), j.CheckFor) {
+		failed = append(failed, fmt.Sprintf("check %q", j.CheckFor))
+	}
+	return append(failed, j.ExpectFor(res.Host).Check(res)...)
 }
 
 func (j *Job) Fqdn(name string) string {
@@ -75,6 +280,20 @@ func (j *Job) View(show func(string)) {
 			show(Config.CommentColor("# " + name + ": " + stub))
 		}
 	}
+	var int_or_comment = func(name string, value int, stub string) {
+		if value != 0 {
+			show(Config.NameColor(name) + Config.DivColor(": ") + strconv.Itoa(value))
+		} else {
+			show(Config.CommentColor("# " + name + ": " + stub))
+		}
+	}
+	var duration_or_comment = func(name string, value time.Duration, stub string) {
+		if value != 0 {
+			show(Config.NameColor(name) + Config.DivColor(": ") + value.String())
+		} else {
+			show(Config.CommentColor("# " + name + ": " + stub))
+		}
+	}
 	var bool_or_comment = func(name string, value bool) {
 		if value {
 			show(Config.NameColor(name) + Config.DivColor(": ") + "true")
@@ -91,8 +310,50 @@ func (j *Job) View(show func(string)) {
 
 	bool_or_comment("tty", j.UseTty)
 	text_or_comment("user", j.User, "<current user>")
+	text_or_comment("jump", j.Jump, "<as ssh config says>")
+	text_or_comment("password_from", j.PasswordFrom, "<keys only>")
 
 	text_or_comment("check", j.CheckFor, "<nothing special>")
+	if j.Expect != nil {
+		show(Config.NameColor("expect") + Config.DivColor(":"))
+		j.Expect.View(show, "    ")
+	} else {
+		show(Config.CommentColor("# expect: <nothing special>"))
+	}
+	if len(j.HostExpect) > 0 {
+		show(Config.NameColor("host_expect") + Config.DivColor(":"))
+		var hosts []string
+		for host := range j.HostExpect {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			show("    " + Config.NameColor(host) + Config.DivColor(":"))
+			j.HostExpect[host].View(show, "        ")
+		}
+	} else {
+		show(Config.CommentColor("# host_expect: <none>"))
+	}
+
+	int_or_comment("parallel", j.Parallel, "<no limit>")
+	text_or_comment("batch", string(j.Batch), "<all hosts at once>")
+	text_or_comment("max_fail", string(j.MaxFail), "<no limit>")
+	duration_or_comment("connect_timeout", time.Duration(j.ConnectTimeout), "<no limit>")
+	duration_or_comment("timeout", time.Duration(j.Timeout), "<no limit>")
+	duration_or_comment("server_alive_interval", time.Duration(j.ServerAliveInterval), "<as ssh config says>")
+	int_or_comment("server_alive_count_max", j.ServerAliveCountMax, "<as ssh config says>")
+	int_or_comment("retries", j.Retries, "0")
+	duration_or_comment("retry_delay", time.Duration(j.RetryDelay), DefaultRetryDelay.String())
+	if len(j.RetryOnExit) > 0 {
+		var codes []string
+		for _, code := range j.RetryOnExit {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		show(Config.NameColor("retry_on_exit") + Config.DivColor(": ") + "[" + strings.Join(codes, ", ") + "]")
+	} else {
+		show(Config.CommentColor("# retry_on_exit: []"))
+	}
+	bool_or_comment("retry_dropped", j.RetryDropped)
 
 	text_or_comment("domain", j.Domain, "example.com")
 	show(Config.NameColor("hosts") + Config.DivColor(":"))
@@ -129,7 +390,30 @@ func CreateYaml(name string) {
 	text += "#after: /bin/true\n"
 	text += "#tty: false\n"
 	text += "#user: <current user>\n"
+	text += "#jump: <[user@]bastion[:port][,next-hop...] or none>\n"
+	text += "#password_from: <env:VAR, file:path or prompt>\n"
 	text += "#check: <text to search for>\n"
+	text += "#expect:\n"
+	text += "#    regex: <must match the output>\n"
+	text += "#    not_contains: <must not be in the output>\n"
+	text += "#    exit: [0, 3]\n"
+	text += "#    stderr_empty: true\n"
+	text += "#    json:\n"
+	text += "#        $.status: ok\n"
+	text += "#host_expect:\n"
+	text += "#    host1:\n"
+	text += "#        exit: [0, 1]\n"
+	text += "#parallel: <max hosts at once>\n"
+	text += "#batch: <hosts per wave, like 10 or 5%>\n"
+	text += "#max_fail: <failures to stop after, like 2 or 10%>\n"
+	text += "#connect_timeout: <like 10s>\n"
+	text += "#timeout: <like 5m>\n"
+	text += "#server_alive_interval: <like 30s>\n"
+	text += "#server_alive_count_max: 3\n"
+	text += "#retries: 0\n"
+	text += "#retry_delay: 1s\n"
+	text += "#retry_on_exit: [255]\n"
+	text += "#retry_dropped: false\n"
 	text += "#domain: <domain name to append to hostnames>\n"
 	text += "#hosts:\n"
 	text += "#    - host1\n"
@@ -151,8 +435,9 @@ func ListYaml(dir string, show func(string, string)) {
 	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if FileExists(path) && strings.HasSuffix(path, ".yaml") {
 			j, e := LoadYaml(path, "")
-			if e != nil {
-				panic(e) // should NOT happen
+			if e != nil { // it's only a listing, the others are still there
+				log.Error("Cannot read %q: %v", path, e)
+				return nil
 			}
 			show(path, j.Title)
 		}
@@ -237,5 +522,10 @@ func LoadYaml(name, deflt string) (*Job, error) {
 	}
 	job.Filename = name
 
+	err = job.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	return &job, nil
 }
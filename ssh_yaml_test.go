@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDurationYaml(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want time.Duration
+	}{
+		{"timeout: 30", 30 * time.Second},
+		{"timeout: 1.5", 1500 * time.Millisecond},
+		{"timeout: 30s", 30 * time.Second},
+		{"timeout: 5m", 5 * time.Minute},
+		{"timeout: 250ms", 250 * time.Millisecond},
+		{"server_alive_interval: 15", 15 * time.Second},
+	} {
+		var job Job
+		if err := yaml.Unmarshal([]byte(c.text), &job); err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		got := time.Duration(job.Timeout + job.ServerAliveInterval) // one of them is set
+		if got != c.want {
+			t.Errorf("%q: got %s, want %s", c.text, got, c.want)
+		}
+	}
+	var job Job
+	if err := yaml.Unmarshal([]byte("retry_delay: 5"), &job); err != nil {
+		t.Errorf("retry_delay: %v", err)
+	} else if got := time.Duration(job.RetryDelay); got != 5*time.Second {
+		t.Errorf("retry_delay: got %s, want 5s", got)
+	}
+	if err := yaml.Unmarshal([]byte("timeout: soon"), &job); err == nil {
+		t.Errorf("\"soon\" accepted as %s", job.Timeout)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	job := &Job{RetryOnExit: []int{255}}
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{&ConnectError{io.EOF}, true},
+		{io.EOF, false}, // cut short, the command may be half done
+		{&ssh.ExitMissingError{}, false},
+		{&PeerUnresponsiveError{"h", 3}, false},
+		{&ConnectError{errors.New("dial tcp: connection refused")}, true},
+		{&ConnectError{errors.New("ssh: handshake failed: ssh: unable to authenticate, " +
+			"attempted methods [none password], no supported methods remain")}, false},
+		{&ConnectError{&HostKeyError{"h", "has changed"}}, false},
+		{&MuxExitError{Status: 255}, true},
+		{&MuxExitError{Status: 1}, false},
+	} {
+		if got := job.Retryable(c.err); got != c.want {
+			t.Errorf("%v: got %v, want %v", c.err, got, c.want)
+		}
+	}
+	job.RetryDropped = true
+	for _, err := range []error{io.EOF, &ssh.ExitMissingError{}, &PeerUnresponsiveError{"h", 3}} {
+		if !job.Retryable(err) {
+			t.Errorf("%v: not retried with retry_dropped", err)
+		}
+	}
+}
+
+func TestExpectFor(t *testing.T) {
+	all, web, fqdn, db := &Expect{}, &Expect{}, &Expect{}, &Expect{}
+	job := &Job{Domain: "example.com", Expect: all,
+		HostExpect: map[string]*Expect{"web": web, "web.example.com": fqdn, "db": db}}
+	for _, c := range []struct {
+		host string
+		want *Expect
+	}{
+		{"web.example.com", fqdn}, // the exact name wins, every time
+		{"web", web},
+		{"db.example.com", db},
+		{"db", db},
+		{"mail.example.com", all},
+	} {
+		for i := 0; i < 10; i++ {
+			if got := job.ExpectFor(c.host); got != c.want {
+				t.Errorf("%s: got %p, want %p", c.host, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+// a bad script is left out, not the end of the listing
+func TestListYaml(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"bad.yaml":  "title: Bad\ncommand: uptime\nbatch: lots\nhosts: [a]\n",
+		"good.yaml": "title: Good\ncommand: uptime\nhosts: [a]\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var titles []string
+	ListYaml(dir, func(path, title string) { titles = append(titles, title) })
+	if want := []string{"Good"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("got %q, want %q", titles, want)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for _, c := range []struct {
+		batch Amount
+		want  int // 0 for an error
+	}{
+		{"", 10},
+		{"3", 3},
+		{"25%", 3},
+		{"1%", 1},
+		{"0", 0},
+		{"0%", 0},
+		{"-1", 0},
+		{"lots", 0},
+	} {
+		job := &Job{Batch: c.batch, Hosts: hosts}
+		n, err := job.BatchSize()
+		if c.want == 0 {
+			if err == nil || job.Validate() == nil {
+				t.Errorf("%q: accepted as %d", c.batch, n)
+			}
+		} else if err != nil || n != c.want {
+			t.Errorf("%q: got %d (%v), want %d", c.batch, n, err, c.want)
+		}
+	}
+}
+
+/* EOF */